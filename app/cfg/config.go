@@ -1,10 +1,18 @@
 package cfg
 
 import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	enum "github.com/elephant-insurance/enumerations/v2"
 	"github.com/elephant-insurance/go-microservice-arch/v2/cfg"
 	"github.com/elephant-insurance/go-microservice-arch/v2/dig"
 	"github.com/elephant-insurance/go-microservice-arch/v2/log"
 	"github.com/elephant-insurance/go-microservice-arch/v2/sec"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Config for the ms-sites web service
@@ -35,6 +43,537 @@ type AppConfig struct {
 	StorageAccountName string       `yaml:"StorageAccountName"`
 	BlobContainer      string       `yaml:"BlobContainer"`
 	StorageAccountKey  string       `yaml:"StorageAccountKey"`
+	// StorageServiceURL is where the storage account is when it isn't in Azure, such as http://127.0.0.1:10000 for Azurite
+	StorageServiceURL string `yaml:"StorageServiceURL" config:"optional"`
+	// DefaultAccess is the access policy for projects that don't set one, in config or in their manifest
+	DefaultAccess string `yaml:"DefaultAccess" config:"optional"`
+	// Projects holds per-project settings, keyed by project name
+	Projects map[string]ProjectSettings `yaml:"Projects" config:"optional"`
+	// Extraction limits how much work we will do unpacking a single archive
+	Extraction ExtractionSettings `yaml:"Extraction" config:"optional"`
+	// DiskCache keeps extracted sites on local disk, so that they survive restarts
+	DiskCache DiskCacheSettings `yaml:"DiskCache" config:"optional"`
+	// Warmup loads projects into the cache before we start taking requests
+	Warmup WarmupSettings `yaml:"Warmup" config:"optional"`
+	// Events accepts Event Grid notifications of changes to the container
+	Events EventSettings `yaml:"Events" config:"optional"`
+	// NotFound remembers projects that aren't in the container, and limits lookups of ones we have never seen
+	NotFound NotFoundSettings `yaml:"NotFound" config:"optional"`
+	// Peers lists the other replicas, which we tell about purges, refreshes and activations
+	Peers PeerSettings `yaml:"Peers" config:"optional"`
+	// Login signs people in through an OpenID Connect provider, so that protected sites work in a browser
+	Login LoginSettings `yaml:"Login" config:"optional"`
+	// SignedURLs limits the links to protected documents we hand out, signed with the Security access keys
+	SignedURLs SignedURLSettings `yaml:"SignedURLs" config:"optional"`
+	// Proxies says how far to trust X-Forwarded-For when working out the client's address
+	Proxies ProxySettings `yaml:"Proxies" config:"optional"`
+	// RateLimits caps how fast one client, or one project, can make us work
+	RateLimits RateLimitSettings `yaml:"RateLimits" config:"optional"`
+	// SecurityHeaders replaces the default security headers we send with every response
+	SecurityHeaders SecurityHeaderSettings `yaml:"SecurityHeaders" config:"optional"`
+}
+
+// RateLimitSettings are token-bucket limits, in requests per minute with bursts of up to a minute's worth; 0 turns a limit off.
+// ClientPerMinute (default 1200) and ProjectPerMinute (default 0) count every request from one client address or for one project.
+// The tighter ClientBackendPerMinute (default 120) and ProjectBackendPerMinute (default 600) count only those
+// the cache can't answer, which cost a trip to the container. MaxClients caps how many client addresses we track (default 100000).
+type RateLimitSettings struct {
+	ClientPerMinute         *int `yaml:"ClientPerMinute" config:"optional"`
+	ProjectPerMinute        *int `yaml:"ProjectPerMinute" config:"optional"`
+	ClientBackendPerMinute  *int `yaml:"ClientBackendPerMinute" config:"optional"`
+	ProjectBackendPerMinute *int `yaml:"ProjectBackendPerMinute" config:"optional"`
+	MaxClients              *int `yaml:"MaxClients" config:"optional"`
+}
+
+// SecurityHeaderSettings are the values of the security headers we send. An empty setting keeps the value
+// from the level above (the defaults, then these settings, then the project's) and SecurityHeaderOff drops the header.
+// ContentSecurityPolicy is sent as Content-Security-Policy-Report-Only while CSPReportOnly is true,
+// so that a policy can be tried before it is enforced.
+type SecurityHeaderSettings struct {
+	StrictTransportSecurity string `yaml:"StrictTransportSecurity" config:"optional"`
+	ContentTypeOptions      string `yaml:"ContentTypeOptions" config:"optional"`
+	FrameOptions            string `yaml:"FrameOptions" config:"optional"`
+	ReferrerPolicy          string `yaml:"ReferrerPolicy" config:"optional"`
+	PermissionsPolicy       string `yaml:"PermissionsPolicy" config:"optional"`
+	ContentSecurityPolicy   string `yaml:"ContentSecurityPolicy" config:"optional"`
+	CSPReportOnly           *bool  `yaml:"CSPReportOnly" config:"optional"`
+}
+
+// SecurityHeaderOff, as the value of a security header setting, stops the header being sent
+const SecurityHeaderOff = `off`
+
+// ProxySettings describes the proxies in front of us. Hops is how many of them add the address they got the request from
+// to X-Forwarded-For, so that the client is that many entries from the end. Without Hops the header isn't trusted at all.
+type ProxySettings struct {
+	Hops *int `yaml:"Hops" config:"optional"`
+}
+
+// SignedURLSettings limits how long signed URLs last: DefaultMinutes when the caller doesn't say (default 60),
+// and never more than MaxMinutes (default 10080, a week).
+type SignedURLSettings struct {
+	DefaultMinutes *int `yaml:"DefaultMinutes" config:"optional"`
+	MaxMinutes     *int `yaml:"MaxMinutes" config:"optional"`
+}
+
+// LoginSettings turns on the browser login flow when Issuer is set.
+// RedirectURL is our /auth/callback as the browser sees it, and SessionKey, at least 32 characters,
+// encrypts the session cookie: every replica must share it.
+// Scopes default to openid,profile,email, RolesClaim to groups and SessionMinutes to 480.
+type LoginSettings struct {
+	Issuer         string `yaml:"Issuer" config:"optional"`
+	ClientID       string `yaml:"ClientID" config:"optional"`
+	ClientSecret   string `yaml:"ClientSecret" config:"optional"`
+	RedirectURL    string `yaml:"RedirectURL" config:"optional"`
+	Scopes         string `yaml:"Scopes" config:"optional"`
+	RolesClaim     string `yaml:"RolesClaim" config:"optional"`
+	SessionKey     string `yaml:"SessionKey" config:"optional"`
+	SessionMinutes *int   `yaml:"SessionMinutes" config:"optional"`
+}
+
+// LoginEnabled reports whether the browser login flow is configured
+func (config *AppConfig) LoginEnabled() bool {
+	return config != nil && config.Login.Issuer != ``
+}
+
+// PeerSettings lists the base URLs of the other replicas, comma-separated, and the key they share,
+// which they send each other in an X-Peer-Key header.
+// Test records notifications instead of sending them, for local runs.
+type PeerSettings struct {
+	URLs string `yaml:"URLs" config:"optional"`
+	Key  string `yaml:"Key" config:"optional"`
+	Test bool   `yaml:"Test" config:"optional"`
+}
+
+// NotFoundSettings controls negative caching. Seconds is how long we remember that something isn't in the container
+// (default 60, 0 turns it off), MaxEntries caps how many misses we remember (default 10000),
+// and UnknownLookupsPerMinute caps how often we look for projects we have never found, and for missing files of each blob mode project
+// (default 120, 0 for no cap).
+type NotFoundSettings struct {
+	Seconds                 *int `yaml:"Seconds" config:"optional"`
+	MaxEntries              *int `yaml:"MaxEntries" config:"optional"`
+	UnknownLookupsPerMinute *int `yaml:"UnknownLookupsPerMinute" config:"optional"`
+}
+
+// EventSettings turns on the storage event endpoint when Key is set.
+// Event Grid must send the key in an X-Event-Key header, set as a delivery property of the subscription.
+type EventSettings struct {
+	Key string `yaml:"Key" config:"optional"`
+}
+
+// DiskCacheSettings turns on the disk cache when Dir is set; MaxBytes defaults to 1GB
+type DiskCacheSettings struct {
+	Dir      string `yaml:"Dir" config:"optional"`
+	MaxBytes *int   `yaml:"MaxBytes" config:"optional"`
+}
+
+// ExtractionSettings caps the resources a single archive may use while it is extracted.
+// Any limit left unset uses the service default.
+type ExtractionSettings struct {
+	MaxCompressedBytes   *int `yaml:"MaxCompressedBytes" config:"optional"`
+	MaxUncompressedBytes *int `yaml:"MaxUncompressedBytes" config:"optional"`
+	MaxEntries           *int `yaml:"MaxEntries" config:"optional"`
+	MaxFileBytes         *int `yaml:"MaxFileBytes" config:"optional"`
+	MaxCompressionRatio  *int `yaml:"MaxCompressionRatio" config:"optional"`
+	// files bigger than SpillBytes are kept in SpillDir instead of in memory; SpillDir defaults to the system temp directory
+	SpillBytes *int   `yaml:"SpillBytes" config:"optional"`
+	SpillDir   string `yaml:"SpillDir" config:"optional"`
+}
+
+// project source modes
+const (
+	// ModeArchive serves a project from an archive of the whole site; this is the default
+	ModeArchive = `archive`
+	// ModeBlob serves a project from one blob per file, <project>/<path>, fetched as requested
+	ModeBlob = `blob`
+)
+
+// ProjectSettings holds the settings for a single project (site) in the container
+type ProjectSettings struct {
+	// Release pins the project to a named release; empty means the default <project>.tar.gz (or .zip) archive
+	Release string          `yaml:"Release" config:"optional"`
+	Canary  *CanarySettings `yaml:"Canary" config:"optional"`
+	// Mode is where the project's files come from, ModeArchive or ModeBlob; releases and canaries only apply to archives
+	Mode string `yaml:"Mode" config:"optional"`
+	// StripWrapper serves an archive with everything inside one folder from inside that folder; it defaults to true
+	StripWrapper *bool `yaml:"StripWrapper" config:"optional"`
+	// Access is who may see the project, one of the Access policies. It overrides the site's own manifest.
+	Access string `yaml:"Access" config:"optional"`
+	// AccessKeys are the keys for AccessKey projects, comma-separated; without them the Security access keys are used
+	AccessKeys string `yaml:"AccessKeys" config:"optional"`
+	// BasicAuth holds the users of AccessBasic projects as comma-separated user:bcrypt-hash pairs.
+	// It replaces the users in the site's own manifest.
+	BasicAuth string `yaml:"BasicAuth" config:"optional"`
+	// AllowedIPs are the client addresses or CIDR ranges, comma-separated, that may see the project at all, whatever its access.
+	// They replace the addresses in the site's own manifest.
+	AllowedIPs string `yaml:"AllowedIPs" config:"optional"`
+	// SecurityHeaders overrides the security headers for the project
+	SecurityHeaders *SecurityHeaderSettings `yaml:"SecurityHeaders" config:"optional"`
+	// CORS says which other origins may use the project's documents, over the global AllowedOrigins.
+	// It overrides the CORS policy in the site's own manifest, setting by setting.
+	CORS *CORSSettings `yaml:"CORS" config:"optional"`
+	// Roles maps path patterns within the project to the agent roles, comma-separated, that may see them.
+	// It replaces the roles in the site's own manifest.
+	Roles map[string]string `yaml:"Roles" config:"optional"`
+}
+
+// CORSSettings are a project's CORS policy in config: Origins, Methods and Headers are comma-separated.
+type CORSSettings struct {
+	Origins       string `yaml:"Origins" config:"optional"`
+	Methods       string `yaml:"Methods" config:"optional"`
+	Headers       string `yaml:"Headers" config:"optional"`
+	MaxAgeSeconds *int   `yaml:"MaxAgeSeconds" config:"optional"`
+}
+
+// CORSPolicy is the CORS policy of a project, from its site manifest or its settings, over the global CORS settings.
+// Origins replace the global AllowedOrigins, and may use one * as a wildcard; CORSOff on its own lets no other origin in.
+// Methods replace the global AllowedMethods and Headers the global AllowedHeaders, though GET, HEAD and OPTIONS,
+// and the standard request headers, are always allowed. MaxAgeSeconds is how long a browser may keep a preflight answer.
+type CORSPolicy struct {
+	Origins       []string `json:"origins,omitempty"`
+	Methods       []string `json:"methods,omitempty"`
+	Headers       []string `json:"headers,omitempty"`
+	MaxAgeSeconds *int     `json:"maxAgeSeconds,omitempty"`
+}
+
+// CORSOff as the only origin of a CORS policy lets no other origin use the project
+const CORSOff = `off`
+
+// CORS methods a project may allow
+var corsMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+}
+
+// access policies
+const (
+	// AccessPublic lets anybody see a project; this is the default
+	AccessPublic = `public`
+	// AccessKey requires an access key, in the apikey header
+	AccessKey = `key`
+	// AccessOkta requires an Okta access token, from the Okta settings under Security
+	AccessOkta = `okta`
+	// AccessMsLogin requires a token that ms-login accepts, from MsLoginBaseURL under Security
+	AccessMsLogin = `mslogin`
+	// AccessLogin requires a session from the browser login flow, under Login
+	AccessLogin = `login`
+	// AccessBasic requires HTTP Basic credentials of one of the project's users
+	AccessBasic = `basic`
+)
+
+// ValidAccess reports whether access names an access policy
+func ValidAccess(access string) bool {
+	switch access {
+	case AccessPublic, AccessKey, AccessOkta, AccessMsLogin, AccessLogin, AccessBasic:
+		return true
+	}
+
+	return false
+}
+
+// CanarySettings sends a percentage of new visitors to a second release of a project
+type CanarySettings struct {
+	Release string `yaml:"Release" config:"optional"`
+	Percent *int   `yaml:"Percent" config:"optional"`
+}
+
+// WarmupSettings lists the projects to load at startup, comma-separated, with * meaning every project in the container.
+// If RefreshMinutes is set they are loaded again on that schedule.
+type WarmupSettings struct {
+	Projects       string `yaml:"Projects" config:"optional"`
+	RefreshMinutes *int   `yaml:"RefreshMinutes" config:"optional"`
+	// Parallelism is how many projects are loaded at once (default 4)
+	Parallelism *int `yaml:"Parallelism" config:"optional"`
+	// WaitSeconds is how long startup waits for the warm-up before listening anyway (default 60)
+	WaitSeconds *int `yaml:"WaitSeconds" config:"optional"`
+}
+
+// WarmupProjects returns the warm-up list
+func (config *AppConfig) WarmupProjects() []string {
+	rtn := []string{}
+	if config == nil {
+		return rtn
+	}
+	for _, project := range strings.Split(config.Warmup.Projects, `,`) {
+		if project = strings.TrimSpace(project); project != `` {
+			rtn = append(rtn, project)
+		}
+	}
+
+	return rtn
+}
+
+// PeerURLs returns the peer list
+func (config *AppConfig) PeerURLs() []string {
+	rtn := []string{}
+	if config == nil {
+		return rtn
+	}
+	for _, peer := range strings.Split(config.Peers.URLs, `,`) {
+		if peer = strings.TrimSpace(peer); peer != `` {
+			rtn = append(rtn, peer)
+		}
+	}
+
+	return rtn
+}
+
+// AccessFor returns the access policy for project: its own setting, or what its site manifest says, or the default
+func (config *AppConfig) AccessFor(project, manifestAccess string) string {
+	if access := config.ForProject(project).Access; access != `` {
+		return access
+	}
+	if manifestAccess != `` {
+		return manifestAccess
+	}
+	if config != nil && config.DefaultAccess != `` {
+		return config.DefaultAccess
+	}
+
+	return AccessPublic
+}
+
+// RolesFor returns the role rules of project, path pattern to roles: those in config if it has any, otherwise manifestRoles
+func (config *AppConfig) RolesFor(project string, manifestRoles map[string][]string) map[string][]string {
+	configured := config.ForProject(project).Roles
+	if len(configured) == 0 {
+		return manifestRoles
+	}
+	rtn := make(map[string][]string, len(configured))
+	for pattern, roles := range configured {
+		for _, role := range strings.Split(roles, `,`) {
+			if role = strings.TrimSpace(role); role != `` {
+				rtn[pattern] = append(rtn[pattern], role)
+			}
+		}
+	}
+
+	return rtn
+}
+
+// AccessConfigured reports whether config alone settles who may see project, so that it can be checked before the site is loaded
+func (config *AppConfig) AccessConfigured(project string) bool {
+	ps := config.ForProject(project)
+
+	return ps.Access != `` && (ps.Access != AccessBasic || ps.BasicAuth != ``)
+}
+
+// BasicAuthFor returns the users of an AccessBasic project, user to bcrypt hash: those in config if it has any, otherwise manifestUsers
+func (config *AppConfig) BasicAuthFor(project string, manifestUsers map[string]string) map[string]string {
+	configured := config.ForProject(project).BasicAuth
+	if configured == `` {
+		return manifestUsers
+	}
+	rtn := map[string]string{}
+	for _, pair := range strings.Split(configured, `,`) {
+		if user, hash, found := strings.Cut(strings.TrimSpace(pair), `:`); found && user != `` {
+			rtn[user] = hash
+		}
+	}
+
+	return rtn
+}
+
+// CheckBasicAuthUser makes sure hash is a bcrypt hash for user
+func CheckBasicAuthUser(user, hash string) error {
+	if user == `` || strings.Contains(user, `:`) {
+		return fmt.Errorf(`bad user name %q`, user)
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return fmt.Errorf(`password for %v is not a bcrypt hash`, user)
+	}
+
+	return nil
+}
+
+// AllowedIPsFor returns the address ranges that may see project, or nil if any may: those in config if it has any, otherwise manifestIPs.
+// Entries that aren't addresses or CIDR ranges are left out; PostValidate and the manifest check report them.
+func (config *AppConfig) AllowedIPsFor(project string, manifestIPs []string) []*net.IPNet {
+	entries := manifestIPs
+	if configured := config.ForProject(project).AllowedIPs; configured != `` {
+		entries = strings.Split(configured, `,`)
+	}
+	var rtn []*net.IPNet
+	for _, entry := range entries {
+		if ipNet, err := ParseIPRange(entry); err == nil {
+			rtn = append(rtn, ipNet)
+		}
+	}
+	if rtn == nil && len(entries) > 0 {
+		// every entry was bad: let nobody in rather than everybody
+		rtn = []*net.IPNet{}
+	}
+
+	return rtn
+}
+
+// ParseIPRange parses a CIDR range, or a single address as a range of one
+func ParseIPRange(entry string) (*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if !strings.Contains(entry, `/`) {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf(`bad address %q`, entry)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(entry)
+	if err != nil {
+		return nil, fmt.Errorf(`bad address range %q`, entry)
+	}
+
+	return ipNet, nil
+}
+
+// CheckRoleRule makes sure pattern is a path pattern and each of roles is an agent role
+func CheckRoleRule(pattern string, roles []string) error {
+	if _, err := path.Match(pattern, ``); err != nil || strings.Trim(pattern, `/`) == `` {
+		return fmt.Errorf(`bad path pattern %q`, pattern)
+	}
+	if len(roles) == 0 {
+		return fmt.Errorf(`no roles for %q`, pattern)
+	}
+	for _, role := range roles {
+		if enum.AgentRole.ByIDString(role) == nil {
+			return fmt.Errorf(`unknown role %q for %q`, role, pattern)
+		}
+	}
+
+	return nil
+}
+
+// CORSFor returns the CORS policy of project, or nil if it has none and the global one applies:
+// manifestPolicy, if there is one, with each setting that is in config replacing its own.
+func (config *AppConfig) CORSFor(project string, manifestPolicy *CORSPolicy) *CORSPolicy {
+	configured := config.ForProject(project).CORS
+	if configured == nil {
+		return manifestPolicy
+	}
+	rtn := CORSPolicy{}
+	if manifestPolicy != nil {
+		rtn = *manifestPolicy
+	}
+	for _, setting := range []struct {
+		to   *[]string
+		from string
+	}{
+		{&rtn.Origins, configured.Origins},
+		{&rtn.Methods, configured.Methods},
+		{&rtn.Headers, configured.Headers},
+	} {
+		if list := splitList(setting.from); len(list) > 0 {
+			*setting.to = list
+		}
+	}
+	if configured.MaxAgeSeconds != nil {
+		rtn.MaxAgeSeconds = configured.MaxAgeSeconds
+	}
+	if len(rtn.Origins) == 0 && len(rtn.Methods) == 0 && len(rtn.Headers) == 0 && rtn.MaxAgeSeconds == nil {
+		return nil
+	}
+
+	return &rtn
+}
+
+// CheckCORSPolicy makes sure the origins of policy are origins, and its methods HTTP methods we can allow
+func CheckCORSPolicy(policy *CORSPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	for _, origin := range policy.Origins {
+		switch {
+		case origin == CORSOff:
+			if len(policy.Origins) > 1 {
+				return fmt.Errorf(`origin %v can't be combined with other origins`, CORSOff)
+			}
+		case strings.Count(origin, `*`) > 1:
+			return fmt.Errorf(`origin %q has more than one wildcard`, origin)
+		case !strings.Contains(origin, `*`) && !strings.HasPrefix(origin, `http://`) && !strings.HasPrefix(origin, `https://`):
+			return fmt.Errorf(`origin %q must start with http:// or https://`, origin)
+		}
+	}
+	for _, method := range policy.Methods {
+		if !corsMethods[method] {
+			return fmt.Errorf(`method %q can't be allowed`, method)
+		}
+	}
+	if policy.MaxAgeSeconds != nil && *policy.MaxAgeSeconds < 0 {
+		return fmt.Errorf(`max age can't be negative`)
+	}
+
+	return nil
+}
+
+// splitList returns the entries of a comma-separated list, without spaces or empty entries
+func splitList(list string) []string {
+	rtn := []string{}
+	for _, entry := range strings.Split(list, `,`) {
+		if entry = strings.TrimSpace(entry); entry != `` {
+			rtn = append(rtn, entry)
+		}
+	}
+
+	return rtn
+}
+
+// AccessKeysFor returns the keys that open an AccessKey project
+func (config *AppConfig) AccessKeysFor(project string) []string {
+	rtn := []string{}
+	if config == nil {
+		return rtn
+	}
+	for _, key := range strings.Split(config.ForProject(project).AccessKeys, `,`) {
+		if key = strings.TrimSpace(key); key != `` {
+			rtn = append(rtn, key)
+		}
+	}
+	if len(rtn) == 0 {
+		for _, key := range []string{config.Security.AccessKey1, config.Security.AccessKey2} {
+			if key != `` {
+				rtn = append(rtn, key)
+			}
+		}
+	}
+
+	return rtn
+}
+
+// ForProject returns the settings for the named project, or empty settings if there are none
+func (config *AppConfig) ForProject(project string) ProjectSettings {
+	if config == nil || config.Projects == nil {
+		return ProjectSettings{}
+	}
+
+	return config.Projects[project]
+}
+
+// StripsWrapper reports whether archives of the project with everything inside one folder are served from inside it
+func (ps ProjectSettings) StripsWrapper() bool {
+	return ps.StripWrapper == nil || *ps.StripWrapper
+}
+
+// HasProject reports whether project has settings of its own or is on the warm-up list
+func (config *AppConfig) HasProject(project string) bool {
+	if config == nil {
+		return false
+	}
+	if _, found := config.Projects[project]; found {
+		return true
+	}
+	for _, warm := range config.WarmupProjects() {
+		if warm == project {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (config *AppConfig) PreValidate() []string {
@@ -44,6 +583,110 @@ func (config *AppConfig) PreValidate() []string {
 
 func (config *AppConfig) PostValidate(previousErrors []string) []string {
 	// Post-validate here, if you need to
+	if len(config.PeerURLs()) > 0 && config.Peers.Key == `` {
+		previousErrors = append(previousErrors, `INVALID CONFIG: peers need a key`)
+	}
+	if config.LoginEnabled() {
+		if config.Login.ClientID == `` || config.Login.RedirectURL == `` {
+			previousErrors = append(previousErrors, `INVALID CONFIG: login needs a ClientID and RedirectURL`)
+		}
+		if len(config.Login.SessionKey) < 32 {
+			previousErrors = append(previousErrors, `INVALID CONFIG: login SessionKey must be at least 32 characters`)
+		}
+	}
+	if config.DefaultAccess != `` {
+		previousErrors = append(previousErrors, config.validateAccess(`the default`, config.DefaultAccess)...)
+	}
+	for name, ps := range config.Projects {
+		if ps.Mode != `` && ps.Mode != ModeArchive && ps.Mode != ModeBlob {
+			previousErrors = append(previousErrors, fmt.Sprintf(`INVALID CONFIG: mode for project %v must be %v or %v`, name, ModeArchive, ModeBlob))
+		}
+		if ps.Access != `` {
+			previousErrors = append(previousErrors, config.validateAccess(`project `+name, ps.Access)...)
+		}
+		if ps.Access == AccessKey && len(config.AccessKeysFor(name)) == 0 {
+			previousErrors = append(previousErrors, fmt.Sprintf(`INVALID CONFIG: project %v needs access keys`, name))
+		}
+		for user, hash := range config.BasicAuthFor(name, nil) {
+			if err := CheckBasicAuthUser(user, hash); err != nil {
+				previousErrors = append(previousErrors, fmt.Sprintf(`INVALID CONFIG: basic auth for project %v: %v`, name, err))
+			}
+		}
+		if ps.BasicAuth != `` && len(config.BasicAuthFor(name, nil)) == 0 {
+			previousErrors = append(previousErrors, fmt.Sprintf(`INVALID CONFIG: basic auth for project %v must be user:hash pairs`, name))
+		}
+		if ps.AllowedIPs != `` {
+			for _, entry := range strings.Split(ps.AllowedIPs, `,`) {
+				if _, err := ParseIPRange(entry); err != nil {
+					previousErrors = append(previousErrors, fmt.Sprintf(`INVALID CONFIG: allowed IPs for project %v: %v`, name, err))
+				}
+			}
+		}
+		for pattern, roles := range config.RolesFor(name, nil) {
+			if err := CheckRoleRule(pattern, roles); err != nil {
+				previousErrors = append(previousErrors, fmt.Sprintf(`INVALID CONFIG: roles for project %v: %v`, name, err))
+			}
+		}
+		if err := CheckCORSPolicy(config.CORSFor(name, nil)); err != nil {
+			previousErrors = append(previousErrors, fmt.Sprintf(`INVALID CONFIG: CORS for project %v: %v`, name, err))
+		}
+		if ps.Canary == nil {
+			continue
+		}
+		if ps.Canary.Release == `` {
+			previousErrors = append(previousErrors, fmt.Sprintf(`INVALID CONFIG: canary for project %v has no release`, name))
+		}
+		if ps.Canary.Percent == nil || *ps.Canary.Percent < 0 || *ps.Canary.Percent > 100 {
+			previousErrors = append(previousErrors, fmt.Sprintf(`INVALID CONFIG: canary percent for project %v must be between 0 and 100`, name))
+		}
+	}
 
 	return previousErrors
 }
+
+// validateAccess checks an access policy, and that the settings it needs are there
+func (config *AppConfig) validateAccess(what, access string) []string {
+	if err := config.CheckAccess(access); err != nil {
+		return []string{fmt.Sprintf(`INVALID CONFIG: access for %v: %v`, what, err)}
+	}
+
+	return nil
+}
+
+// CheckAccess makes sure access names an access policy, and that the settings it needs are there,
+// so that a policy from a site manifest can be held to the same rules as one from config
+func (config *AppConfig) CheckAccess(access string) error {
+	switch {
+	case !ValidAccess(access):
+		return fmt.Errorf(`must be %v, %v, %v, %v, %v or %v`, AccessPublic, AccessKey, AccessOkta, AccessMsLogin, AccessLogin, AccessBasic)
+	case access == AccessOkta && !config.OktaMode():
+		return fmt.Errorf(`okta access needs OktaBaseAddress and OktaClientID`)
+	case access == AccessLogin && !config.LoginEnabled():
+		return fmt.Errorf(`login access needs Login settings`)
+	case access == AccessMsLogin && !config.msLoginMode():
+		return fmt.Errorf(`mslogin access needs MsLoginBaseURL, without Okta settings or access keys`)
+	}
+
+	return nil
+}
+
+// OktaMode reports whether the sec package will check tokens with Okta, which it does whenever it has the Okta settings
+func (config *AppConfig) OktaMode() bool {
+	return config != nil && config.Security.OktaBaseAddress != `` && config.Security.OktaClientID != ``
+}
+
+// KeyMode reports whether the sec package checks a shared access key instead of a token, which it does when it has both keys and no Okta settings
+func (config *AppConfig) KeyMode() bool {
+	return config != nil && !config.OktaMode() && config.Security.AccessKey1 != `` && config.Security.AccessKey2 != ``
+}
+
+// msLoginMode reports whether the sec package will check tokens with ms-login, which it only does when it has no Okta settings or access keys
+func (config *AppConfig) msLoginMode() bool {
+	if config == nil {
+		return false
+	}
+	s := config.Security
+	keys := s.AccessKey1 != `` && s.AccessKey2 != ``
+
+	return s.MsLoginBaseURL != `` && !config.OktaMode() && !keys
+}
@@ -0,0 +1,272 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	enum "github.com/elephant-insurance/enumerations/v2"
+	"github.com/elephant-insurance/go-microservice-arch/v2/log"
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+	"github.com/elephant-insurance/go-microservice-arch/v2/sec"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+	"github.com/elephant-insurance/ms-sites/app/services"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// accessKeyHeader carries the access key of a project; never the URL, which ends up in logs and browser history
+	accessKeyHeader = `apikey`
+	// secUserClaims is where sec keeps the claims of an Okta token it has verified
+	secUserClaims = `UserClaims`
+)
+
+var (
+	// oktaCheck runs the sec package's Okta check, calling its handler if the token is good.
+	// Only in Okta mode is that a token check: otherwise sec checks an access key or an ms-login token instead.
+	oktaCheck = sec.AuthorizeUserForHandler
+	// msLoginCheck runs the sec package's ms-login check, calling its handler if the token is good
+	msLoginCheck = sec.AuthorizeUsingMsLogin
+)
+
+// authorize checks the visitor against the access policy of project, and sends 401 if they may not see it.
+// Anything that isn't public is marked private, so that shared caches don't hand it to anybody else.
+// site is the project's manifest, or nil if it hasn't been loaded.
+func authorize(c *gin.Context, project, access string, site *services.SiteManifest) bool {
+	if access == cfg.AccessPublic {
+		return true
+	}
+	c.Header("Cache-Control", "private")
+	if bypassAccess() {
+		log.ForFunc(c).SetName(project).Warn(`bypassing access policy in dev/test environment`)
+		return true
+	}
+
+	allowed := false
+	switch access {
+	case cfg.AccessKey:
+		allowed = keyAllowed(c, project)
+	case cfg.AccessOkta:
+		allowed = sessionAllowed(c) || oktaAllowed(c)
+	case cfg.AccessMsLogin:
+		if sessionAllowed(c) {
+			return true
+		}
+		if loginRedirect(c) {
+			return false
+		}
+		// sec sends its own 401
+		msLoginCheck(func(*gin.Context) { allowed = true })(c)
+		return allowed
+	case cfg.AccessLogin:
+		allowed = sessionAllowed(c)
+	case cfg.AccessBasic:
+		allowed = basicAllowed(c, project, site)
+	}
+	if !allowed {
+		log.ForFunc(c).SetName(project).WithConsoleField("access", access).Info("access denied")
+		if c.IsAborted() {
+			// sec has sent its own 401
+			return false
+		}
+		if access == cfg.AccessBasic {
+			c.Header("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, project))
+		}
+		if access == cfg.AccessKey || access == cfg.AccessBasic || !loginRedirect(c) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not Authorized"})
+		}
+	}
+
+	return allowed
+}
+
+// RequireCredentials turns away requests without a bearer token before they reach handler, when sec is in Okta mode.
+// In key mode it marks requests with a shared access key, so that what they do is audited as done with it.
+// It goes in front of sec.AuthorizeUserForHandler, which in Okta mode lets a request through
+// unless its Authorization header is a scheme and a token.
+func RequireCredentials(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !bypassAccess() && cfg.Config.OktaMode() && bearerToken(c) == `` {
+			log.ForFunc(c).Info("no credentials")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not Authorized"})
+			return
+		}
+		if sharedKeyUsed(c) {
+			c.Set(services.SharedKeyContextKey, true)
+		}
+		handler(c)
+	}
+}
+
+// sharedKeyUsed reports whether, in key mode, the request carries one of the access keys, where sec looks for them.
+// sec itself turns away the request if it doesn't, and leaves no token if it does.
+func sharedKeyUsed(c *gin.Context) bool {
+	if !cfg.Config.KeyMode() {
+		return false
+	}
+	given := c.Query("key")
+	if given == `` {
+		given = c.GetHeader(accessKeyHeader)
+	}
+	if given == `` {
+		return false
+	}
+	s := cfg.Config.Security
+	for _, key := range []string{s.AccessKey1, s.AccessKey2} {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(key)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowClientIP checks the client address against the ranges that may see project, sending 403 if it isn't in any.
+// No ranges means any address may.
+func allowClientIP(c *gin.Context, project string, ranges []*net.IPNet) bool {
+	if ranges == nil {
+		return true
+	}
+	c.Header("Cache-Control", "private")
+	ip := services.ClientIP(c.Request)
+	for _, ipNet := range ranges {
+		if ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	log.ForFunc(c).SetName(project).WithConsoleField("ip", ip.String()).Info("address not allowed")
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+
+	return false
+}
+
+// basicAllowed checks HTTP Basic credentials against the users of project, from config or else its manifest
+func basicAllowed(c *gin.Context, project string, site *services.SiteManifest) bool {
+	user, password, found := c.Request.BasicAuth()
+	if !found {
+		return false
+	}
+	var manifestUsers map[string]string
+	if site != nil {
+		manifestUsers = site.BasicAuth
+	}
+
+	return services.CheckBasicAuth(cfg.Config.BasicAuthFor(project, manifestUsers), user, password)
+}
+
+// authorizeRoles checks that the visitor has one of roles, sending 401 if we don't know who they are and 403 if they may not see it.
+// Who they are comes from the token the project's access policy checked, or else a login session or Okta token.
+func authorizeRoles(c *gin.Context, project string, roles []enum.AgentRoleID) bool {
+	c.Header("Cache-Control", "private")
+	if bypassAccess() {
+		return true
+	}
+
+	token := visitorToken(c)
+	if token == nil && (sessionAllowed(c) || oktaAllowed(c)) {
+		token = visitorToken(c)
+	}
+	if token == nil {
+		log.ForFunc(c).SetName(project).Info("roles required, but visitor unknown")
+		if !c.IsAborted() && !loginRedirect(c) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not Authorized"})
+		}
+		return false
+	}
+	if !token.IsRoleExist(roles) {
+		log.ForFunc(c).SetName(project).WithConsoleField("subject", token.Subject).Info("visitor lacks the roles")
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return false
+	}
+
+	return true
+}
+
+// visitorToken returns the access token of the visitor, as sec.TokenFromContext does but without its warning when there is none
+func visitorToken(c *gin.Context) *sec.AccessToken {
+	key := sec.ContextKeyAccessToken
+	if t, exists := msrqc.NamespaceGet(c, &msrqc.NamespaceKeySec, &key); exists {
+		if token, ok := t.(sec.AccessToken); ok {
+			return &token
+		}
+	}
+
+	return nil
+}
+
+// bypassAccess follows the sec package: with BypassInDev, nothing is checked in development and testing
+func bypassAccess() bool {
+	bypass := cfg.Config.Security.ByPassInDev
+	if bypass == nil || !*bypass {
+		return false
+	}
+	env := cfg.Config.RequiredConfig.GetEnvironment()
+
+	return env.Equals(&enum.ServiceEnvironment.Development.ID) || env.Equals(&enum.ServiceEnvironment.Testing.ID)
+}
+
+// keyAllowed checks the apikey header against the keys of project.
+// Links to share go out as signed URLs instead.
+func keyAllowed(c *gin.Context, project string) bool {
+	given := c.GetHeader(accessKeyHeader)
+	if given == `` {
+		return false
+	}
+	for _, key := range cfg.Config.AccessKeysFor(project) {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(key)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// oktaAllowed checks the bearer token with the sec package, which it only does in Okta mode; in any other mode it is refused.
+// Unlike sec, a request with no token is turned away; one with a token sec turns away has been sent its 401.
+func oktaAllowed(c *gin.Context) bool {
+	if !cfg.Config.OktaMode() || bearerToken(c) == `` {
+		return false
+	}
+
+	allowed := false
+	oktaCheck(func(*gin.Context) { allowed = true })(c)
+	if !allowed {
+		return false
+	}
+	claims, found := c.Get(secUserClaims)
+	verified, ok := claims.(sec.OktaClaims)
+	if !found || !ok {
+		log.ForFunc(c).Error("sec passed an Okta token without its claims")
+		return false
+	}
+	setAccessToken(c, oktaAccessToken(verified))
+
+	return true
+}
+
+// bearerToken returns the token in the Authorization header if it is a bearer token sec will check,
+// which it only does when the header is the scheme and the token separated by one space
+func bearerToken(c *gin.Context) string {
+	parts := strings.Split(c.GetHeader(sec.AuthHeaderKey), ` `)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], `Bearer`) || strings.TrimSpace(parts[1]) == `` {
+		return ``
+	}
+
+	return parts[1]
+}
+
+// oktaAccessToken describes the claims of an Okta access token sec has verified the way sec does, with its scopes as the scope
+func oktaAccessToken(claims sec.OktaClaims) sec.AccessToken {
+	token := sec.AccessToken{}
+	token.Subject = claims.Subject
+	token.UserName = claims.Subject
+	token.Scope = append(token.Scope, claims.Scope...)
+	if claims.ExpiredAt != 0 {
+		expires := int64(claims.ExpiredAt)
+		token.ExpTime = &expires
+	}
+
+	return token
+}
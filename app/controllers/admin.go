@@ -0,0 +1,162 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/bc"
+	"github.com/elephant-insurance/go-microservice-arch/v2/log"
+	"github.com/elephant-insurance/ms-sites/app/services"
+	"github.com/gin-gonic/gin"
+)
+
+// cacheDetail is what we send back when asked about one project in the cache
+type cacheDetail struct {
+	services.SnapshotSummary
+	FileList []services.FileSummary `json:"file-list"`
+}
+
+// purgeResult is what we send back from the purge and refresh endpoints
+type purgeResult struct {
+	Project string `json:"project,omitempty"`
+	Purged  int    `json:"purged"`
+	Loaded  int    `json:"loaded,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// signRequest asks for a signed URL to a document, or to every document under a scope, lasting Minutes
+type signRequest struct {
+	Project  string `json:"project"`
+	Document string `json:"document,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	Minutes  int    `json:"minutes,omitempty"`
+}
+
+// HandleListCache lists every snapshot in the cache
+func HandleListCache(c *gin.Context) {
+	log.ForFunc(c).Debug(`called`)
+
+	snaps := services.CachedSnapshots(``)
+	rtn := make([]services.SnapshotSummary, 0, len(snaps))
+	for _, snap := range snaps {
+		rtn = append(rtn, snap.Summary())
+	}
+
+	bc.RenderJSONResponse(c, http.StatusOK, rtn)
+}
+
+// HandleShowCache lists the cached snapshots of a project, with their files
+func HandleShowCache(c *gin.Context) {
+	log.ForFunc(c).Debug(`called`)
+	project := c.Param("project")
+
+	snaps := services.CachedSnapshots(project)
+	if len(snaps) == 0 {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	rtn := make([]cacheDetail, 0, len(snaps))
+	for _, snap := range snaps {
+		rtn = append(rtn, cacheDetail{SnapshotSummary: snap.Summary(), FileList: snap.FileList()})
+	}
+
+	bc.RenderJSONResponse(c, http.StatusOK, rtn)
+}
+
+// HandlePurgeCache drops a project, or everything if no project is given, from the cache
+func HandlePurgeCache(c *gin.Context) {
+	lw := log.ForFunc(c).Debug(`called`)
+	project := c.Param("project")
+
+	result := purgeResult{Project: project, Purged: services.Purge(project)}
+	services.NotifyPeers(services.PeerPurge, project, ``)
+	lw.SetName(project).WithConsoleField("purged", result.Purged).Info("cache purged")
+	services.Audit(c, services.AuditPurge, project, ``, http.StatusOK, fmt.Sprintf(`%v snapshots purged`, result.Purged))
+	bc.RenderJSONResponse(c, http.StatusOK, result)
+}
+
+// HandleRefreshCache loads a project again from the container, replacing what is cached for it once the new snapshots are good
+func HandleRefreshCache(c *gin.Context) {
+	lw := log.ForFunc(c).Debug(`called`)
+	project := c.Param("project")
+	result := purgeResult{Project: project}
+	defer func() { services.Audit(c, services.AuditRefresh, project, ``, c.Writer.Status(), result.Error) }()
+
+	if !services.ValidProjectName(project) {
+		result.Error = `invalid project name`
+		bc.RenderJSONResponse(c, http.StatusBadRequest, result)
+		return
+	}
+
+	result.Purged = len(services.CachedSnapshots(project))
+	if status, err := services.Blob.Refresh(c, project); err != nil {
+		result.Error = err.Error()
+		bc.RenderJSONResponse(c, status, result)
+		return
+	}
+
+	services.NotifyPeers(services.PeerRefresh, project, ``)
+
+	result.Loaded = len(services.CachedSnapshots(project))
+	lw.SetName(project).Info("cache refreshed")
+	bc.RenderJSONResponse(c, http.StatusOK, result)
+}
+
+// HandleListAudit lists the latest audit events, latest first, for the project given in the "project" query parameter or for all of them,
+// up to the "limit" query parameter if it is set
+func HandleListAudit(c *gin.Context) {
+	log.ForFunc(c).Debug(`called`)
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "0"))
+	if err != nil || limit < 0 {
+		bc.RenderJSONResponse(c, http.StatusBadRequest, gin.H{"error": "limit must be a positive number"})
+		return
+	}
+
+	bc.RenderJSONResponse(c, http.StatusOK, services.AuditEvents(c.Query("project"), limit))
+}
+
+// a sign request is a project, a document or scope and a lifetime; nothing near this size
+const maxSignRequestBytes = 4 << 10
+
+// HandleSignURL hands out a time-limited signed URL to a protected document, so that it can be shared without a login
+func HandleSignURL(c *gin.Context) {
+	lw := log.ForFunc(c).Debug(`called`)
+	req := signRequest{}
+	detail := ``
+	defer func() { services.Audit(c, services.AuditSign, req.Project, ``, c.Writer.Status(), detail) }()
+	if err := json.NewDecoder(http.MaxBytesReader(c.Writer, c.Request.Body, maxSignRequestBytes)).Decode(&req); err != nil {
+		lw.WithError(err).Warn("error reading sign request")
+		detail = err.Error()
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	if req.Document == `` && req.Scope == `` {
+		detail = `no document or scope`
+		bc.RenderJSONResponse(c, http.StatusBadRequest, gin.H{"error": "a document or scope is required"})
+		return
+	}
+	docPath, _, err := services.CanonicalDocument(req.Project, req.Document, ``)
+	if err != nil {
+		detail = err.Error()
+		bc.RenderJSONResponse(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	signed, status, err := services.SignURL(req.Project, docPath, req.Scope, req.Minutes)
+	if err != nil {
+		lw.WithError(err).Warn("error signing URL")
+		detail = err.Error()
+		bc.RenderJSONResponse(c, status, gin.H{"error": err.Error()})
+		return
+	}
+
+	detail = fmt.Sprintf(`%v until %v`, docPath, signed.Expires.Format(time.RFC3339))
+	if signed.Scope != `` {
+		detail = fmt.Sprintf(`scope %v until %v`, signed.Scope, signed.Expires.Format(time.RFC3339))
+	}
+	lw.SetName(req.Project).WithConsoleField("scope", signed.Scope).WithConsoleField("expires", signed.Expires).Info("signed URL issued")
+	bc.RenderJSONResponse(c, http.StatusOK, signed)
+}
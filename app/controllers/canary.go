@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/clicker"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+	"github.com/elephant-insurance/ms-sites/app/services"
+	"github.com/gin-gonic/gin"
+)
+
+// releaseCookiePrefix + project is the name of the cookie that pins a visitor to a release
+const releaseCookiePrefix = `ms-sites-release-`
+
+// releaseCounter tracks how one release of a project is doing during a canary rollout
+type releaseCounter struct {
+	Requests *clicker.Clicker `json:"requests"`
+	Errors   *clicker.Clicker `json:"errors"`
+}
+
+var (
+	canaryRandom     = rand.New(rand.NewSource(time.Now().UnixNano()))
+	canaryRandomLock sync.Mutex
+
+	releaseCounters     = map[string]map[string]*releaseCounter{}
+	releaseCountersLock sync.Mutex
+)
+
+// selectRelease decides which release of project to serve for this request.
+// Projects without a canary always get their configured release, or the one activated through the publish API.
+// Otherwise a visitor who already has a cookie for one of the two releases keeps it,
+// and a new visitor is sent to the canary with the configured probability.
+func selectRelease(c *gin.Context, project string) string {
+	ps := cfg.Config.ForProject(project)
+	stable := stableRelease(c, project)
+
+	if ps.Canary == nil || ps.Canary.Release == `` || ps.Canary.Percent == nil {
+		return stable
+	}
+
+	cookieName := releaseCookiePrefix + project
+	if pinned, err := c.Cookie(cookieName); err == nil && (pinned == stable || pinned == ps.Canary.Release) {
+		return pinned
+	}
+
+	release := stable
+	canaryRandomLock.Lock()
+	roll := canaryRandom.Intn(100)
+	canaryRandomLock.Unlock()
+	if roll < *ps.Canary.Percent {
+		release = ps.Canary.Release
+	}
+
+	// no max age, so the visitor keeps this release for the rest of the browser session
+	setCookie(c, cookieName, release, `/`, 0)
+
+	return release
+}
+
+// stableRelease returns the release of project that everybody gets when there is no canary:
+// its configured release, or the one activated through the publish API
+func stableRelease(c *gin.Context, project string) string {
+	if release := cfg.Config.ForProject(project).Release; release != `` {
+		return release
+	}
+
+	return services.Blob.ActiveRelease(c, project)
+}
+
+// countRelease records the outcome of a request for a release of a project with a canary configured
+func countRelease(project, release string, status int) {
+	if ps := cfg.Config.ForProject(project); ps.Canary == nil {
+		return
+	}
+
+	releaseCountersLock.Lock()
+	byRelease, ok := releaseCounters[project]
+	if !ok {
+		byRelease = map[string]*releaseCounter{}
+		releaseCounters[project] = byRelease
+	}
+	counter, ok := byRelease[release]
+	if !ok {
+		counter = &releaseCounter{Requests: &clicker.Clicker{}, Errors: &clicker.Clicker{}}
+		byRelease[release] = counter
+	}
+	releaseCountersLock.Unlock()
+
+	counter.Requests.Click(1)
+	if status >= http.StatusBadRequest {
+		counter.Errors.Click(1)
+	}
+}
+
+// releaseDiagnostics returns the request and error counts for every release we have counted
+func releaseDiagnostics() map[string]map[string]*releaseCounter {
+	releaseCountersLock.Lock()
+	defer releaseCountersLock.Unlock()
+
+	rtn := map[string]map[string]*releaseCounter{}
+	for project, byRelease := range releaseCounters {
+		rtn[project] = map[string]*releaseCounter{}
+		for release, counter := range byRelease {
+			rtn[project][release] = counter
+		}
+	}
+
+	return rtn
+}
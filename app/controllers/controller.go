@@ -1,14 +1,19 @@
 package controllers
 
 import (
+	"errors"
+	"io"
 	"net/http"
-	"path/filepath"
+	"os"
+	"path"
+	"strconv"
 	"strings"
 
 	"github.com/elephant-insurance/go-microservice-arch/v2/clicker"
 	"github.com/elephant-insurance/go-microservice-arch/v2/dig"
 	"github.com/elephant-insurance/go-microservice-arch/v2/log"
 	"github.com/elephant-insurance/go-microservice-arch/v2/uf"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
 	"github.com/elephant-insurance/ms-sites/app/services"
 	"github.com/gin-gonic/gin"
 )
@@ -21,62 +26,205 @@ var (
 	timinigLabelCacheMiss = uf.Pointer.ToString(`cache-miss`)
 )
 
+// retryAfterSeconds is how long we ask clients to wait when the container is unavailable
+const retryAfterSeconds = `5`
+
 func HandleGetDocument(c *gin.Context) {
 
 	lw := log.ForFunc(c).Debug(`called`)
-	var docPath string
 	project := c.Param("project")
-	doc := c.Param("document")
 	if project == "" {
 		c.Status(http.StatusNotFound)
 		return
 	}
-	if doc == "" {
-		docPath = project + "/index.html"
-	} else {
-		docPath = project + `/` + doc
+	// the rest of the path, rather than the document parameter, so that a doubled slash after the project is still seen
+	document := strings.TrimPrefix(c.Request.URL.Path, `/`+project)
+	docPath, status, err := services.CanonicalDocument(project, document, c.Request.URL.EscapedPath())
+	if err != nil {
+		lw.SetName(project).WithError(err).Info("request path turned away")
+		c.Status(status)
+		return
+	}
+	// a signed URL lets its holder past the project's access policy and roles
+	signed := services.SignedURLAllows(project, docPath, c.Request.URL.Query())
+	if signed {
+		c.Header("Cache-Control", "private")
+		c.Header("Referrer-Policy", "no-referrer")
+	}
+	// what is set in config is checked before we go to the trouble of loading the site
+	ipsConfigured := cfg.Config.ForProject(project).AllowedIPs != ``
+	if ipsConfigured && !allowClientIP(c, project, cfg.Config.AllowedIPsFor(project, nil)) {
+		return
+	}
+	configured := cfg.Config.AccessConfigured(project)
+	if !signed && configured && !authorize(c, project, cfg.Config.AccessFor(project, ``), nil) {
+		return
 	}
-	fileExtension := filepath.Ext(docPath)
-	mimeType := services.DetectMimeType(strings.Split(fileExtension, ".")[1])
 
 	retrieveTimer := dig.StartClientTiming(c, uf.Pointer.ToString(`retrieve-doc`), nil)
+	var (
+		snap       *services.Snapshot
+		statusCode int
+	)
+	if cfg.Config.ForProject(project).Mode == cfg.ModeBlob {
+		snap, statusCode, err = loadBlobFile(c, project, docPath)
+	} else {
+		release := selectRelease(c, project)
+		defer func() { countRelease(project, release, c.Writer.Status()) }()
+		snap, statusCode, err = loadArchive(c, project, release)
+	}
+	if err != nil {
+		retrieveTimer.Stop(statusCode)
+		switch statusCode {
+		case http.StatusNotFound:
+			c.Status(http.StatusNotFound)
+		case http.StatusTooManyRequests:
+			tooManyRequests(c, err)
+		case http.StatusServiceUnavailable:
+			// the container is having trouble, or we are being scanned: worth another try shortly
+			c.Header("Retry-After", retryAfterSeconds)
+			c.Status(http.StatusServiceUnavailable)
+		default:
+			c.Writer.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !applyCORS(c, project, snap.Manifest.CORS) {
+		retrieveTimer.Stop(http.StatusForbidden)
+		return
+	}
+	if !ipsConfigured && !allowClientIP(c, project, cfg.Config.AllowedIPsFor(project, snap.Manifest.AllowedIPs)) {
+		retrieveTimer.Stop(http.StatusForbidden)
+		return
+	}
+	if !signed && !configured && !authorize(c, project, cfg.Config.AccessFor(project, snap.Manifest.Access), &snap.Manifest) {
+		retrieveTimer.Stop(http.StatusUnauthorized)
+		return
+	}
+	rules := cfg.Config.RolesFor(project, snap.Manifest.Roles)
+	if roles, restricted := services.RequiredRoles(rules, strings.TrimPrefix(docPath, project)); !signed && restricted && !authorizeRoles(c, project, roles) {
+		retrieveTimer.Stop(c.Writer.Status())
+		return
+	}
+
+	retrieveTimer.Stop(serveDocument(c, snap, docPath))
+	lw.Debug(`complete`)
+}
+
+// loadArchive returns the snapshot of a release of project, from the cache if it is fresh there
+func loadArchive(c *gin.Context, project, release string) (*services.Snapshot, int, error) {
+	lw := log.ForFunc(c)
 	// check if the doc is in cache
-	if downloadData, cacheHit := services.FindInCache(docPath); cacheHit {
+	snap, fresh := services.FindInCache(project, release)
+	if fresh {
 		lw.Debug("Cache hit")
 		CacheHits.Click(1)
-		retrieveTimer.Stop(http.StatusOK)
-		c.Header("Content-Type", mimeType)
-		c.Writer.Write(downloadData)
+		return snap, http.StatusOK, nil
+	}
+	if err := services.AllowBackendRequest(services.ClientIP(c.Request), project); err != nil {
+		if snap != nil {
+			// better a snapshot that is due to be checked than none
+			return snap, http.StatusOK, nil
+		}
+		return nil, http.StatusTooManyRequests, err
+	}
 
-	} else {
-		lw.Debug("Cache miss")
-		CacheMiss.Click(1)
-		//download tarball and unzip and cache
-		err, statusCode := services.Blob.DownloadFiles(c, project)
-		if err != nil {
-			retrieveTimer.Stop(statusCode)
-			if statusCode == http.StatusNotFound {
-				retrieveTimer.Stop(http.StatusNotFound)
-				c.Status(http.StatusNotFound)
-			} else {
-				c.Writer.WriteHeader(http.StatusInternalServerError)
-			}
-		} else {
-			{
-				downloadData, _ := services.FindInCache(docPath)
-				c.Header("Content-Type", mimeType)
-				c.Writer.Write(downloadData)
-				retrieveTimer.Stop(http.StatusOK)
-			}
+	lw.Debug("Cache miss")
+	CacheMiss.Click(1)
+	//download archive and unzip and cache
+	err, statusCode := services.Blob.DownloadFiles(c, project, release)
+	if err != nil {
+		return nil, statusCode, err
+	}
+	snap, _ = services.FindInCache(project, release)
+
+	return snap, http.StatusOK, nil
+}
+
+// loadBlobFile returns the snapshot holding the document at docPath of a project served blob by blob, from the cache if it is fresh there
+func loadBlobFile(c *gin.Context, project, docPath string) (*services.Snapshot, int, error) {
+	lw := log.ForFunc(c)
+	snap, fresh := services.FindFileInCache(docPath)
+	if fresh {
+		lw.Debug("Cache hit")
+		CacheHits.Click(1)
+		return snap, http.StatusOK, nil
+	}
+	if err := services.AllowBackendRequest(services.ClientIP(c.Request), project); err != nil {
+		if snap != nil {
+			// better a snapshot that is due to be checked than none
+			return snap, http.StatusOK, nil
 		}
+		return nil, http.StatusTooManyRequests, err
 	}
 
-	lw.Debug(`complete`)
+	lw.Debug("Cache miss")
+	CacheMiss.Click(1)
+	statusCode, err := services.Blob.DownloadFile(c, project, docPath)
+	if err != nil {
+		return nil, statusCode, err
+	}
+	snap, _ = services.FindFileInCache(docPath)
+
+	return snap, http.StatusOK, nil
+}
+
+// serveDocument writes the document at docPath in snap, with its content type and ETag,
+// or just 304 if the client already has this version. It returns the status it sent.
+func serveDocument(c *gin.Context, snap *services.Snapshot, docPath string) int {
+	doc, size, err := snap.Open(docPath)
+	if errors.Is(err, os.ErrNotExist) {
+		c.Status(http.StatusNotFound)
+		return http.StatusNotFound
+	}
+	if err != nil {
+		log.ForFunc(c).SetName(docPath).WithError(err).Error("error opening document")
+		c.Status(http.StatusInternalServerError)
+		return http.StatusInternalServerError
+	}
+	defer doc.Close()
+
+	snap.Hits.Click(1)
+	etag := snap.FileETag(docPath)
+	c.Header("ETag", etag)
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return http.StatusNotModified
+	}
+
+	c.Header("Content-Type", services.DetectMimeType(strings.TrimPrefix(path.Ext(docPath), ".")))
+	c.Header("Content-Length", strconv.FormatInt(size, 10))
+	c.Writer.WriteHeader(http.StatusOK)
+	io.Copy(c.Writer, doc)
+
+	return http.StatusOK
+}
+
+// etagMatches reports whether an If-None-Match header includes etag
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == `` {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, `,`) {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), `W/`)
+		if candidate == `*` || candidate == etag {
+			return true
+		}
+	}
+
+	return false
 }
 
 func Diagnostics() map[string]interface{} {
 	return map[string]interface{}{
 		`cache-hits`: CacheHits.Clicks,
 		`cache-miss`: CacheMiss.Clicks,
+		`releases`:   releaseDiagnostics(),
+		`limit-hits`: services.LimitBreaches.Clicks,
+		`disk-cache`: services.DiskCacheDiagnostics(),
+		`not-found`:  services.NotFoundDiagnostics(),
+		`signed-url`: services.SignedURLDiagnostics(),
+		`rate-limit`: services.RateLimitDiagnostics(),
 	}
 }
@@ -0,0 +1,171 @@
+package controllers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+	"github.com/elephant-insurance/ms-sites/app/services"
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestContainer stands in for the blob container, serving blobs by name, and points services.Blob at it
+func newTestContainer(t *testing.T, blobs map[string][]byte) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, found := blobs[strings.TrimPrefix(r.URL.Path, `/sites/sites/`)]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set(`ETag`, fmt.Sprintf(`"%x"`, md5.Sum(data)))
+		w.Write(data)
+	}))
+	services.Blob = services.NewBlobServiceAt(server.URL, `sites`, ``, `sites`)
+	t.Cleanup(func() {
+		server.Close()
+		services.Blob = nil
+		services.Purge(``)
+		cfg.Config = nil
+	})
+}
+
+// makeSite makes a site archive of files, by name
+func makeSite(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, body := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(body))
+	}
+	tw.Close()
+	gz.Close()
+
+	return buf.Bytes()
+}
+
+// newTestEngine routes documents to HandleGetDocument behind middleware, as the app's routes do
+func newTestEngine(middleware ...gin.HandlerFunc) *gin.Engine {
+	g := gin.New()
+	g.Use(middleware...)
+	g.GET(`/:project`, HandleGetDocument)
+	g.GET(`/:project/*document`, HandleGetDocument)
+
+	return g
+}
+
+// get sends a GET for url to g, with headers given as name, value pairs
+func get(g *gin.Engine, url string, headers ...string) *httptest.ResponseRecorder {
+	return send(g, http.MethodGet, url, headers...)
+}
+
+func send(g *gin.Engine, method, url string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Add(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestHandleGetDocument(t *testing.T) {
+	cfg.Config = &cfg.AppConfig{}
+	newTestContainer(t, map[string][]byte{
+		`docs.tar.gz`: makeSite(t, map[string]string{`index.html`: `home`, `guide/index.html`: `guide`, `site.css`: `body{}`}),
+	})
+	g := newTestEngine()
+
+	tests := []struct {
+		url    string
+		status int
+		body   string
+	}{
+		{`/docs`, http.StatusOK, `home`},
+		{`/docs/`, http.StatusOK, `home`},
+		{`/docs/guide/`, http.StatusOK, `guide`},
+		{`/docs/guide/index.html`, http.StatusOK, `guide`},
+		{`/docs/site.css`, http.StatusOK, `body{}`},
+		{`/docs/missing.html`, http.StatusNotFound, ``},
+		{`/docs//site.css`, http.StatusBadRequest, ``},
+		{`/docs/guide/../site.css`, http.StatusBadRequest, ``},
+		{`/docs/guide%2Findex.html`, http.StatusBadRequest, ``},
+		{`/docs/.ms-sites.json`, http.StatusNotFound, ``},
+		{`/nothing/`, http.StatusNotFound, ``},
+	}
+	for _, test := range tests {
+		w := get(g, test.url)
+		if w.Code != test.status || (test.body != `` && w.Body.String() != test.body) {
+			t.Errorf(`%v: got %v %q, expected %v %q`, test.url, w.Code, w.Body.String(), test.status, test.body)
+		}
+	}
+
+	w := get(g, `/docs/site.css`)
+	if ct := w.Header().Get(`Content-Type`); !strings.HasPrefix(ct, `text/css`) {
+		t.Errorf(`expected text/css, got %q`, ct)
+	}
+	if w := get(g, `/docs/site.css`, `If-None-Match`, w.Header().Get(`ETag`)); w.Code != http.StatusNotModified {
+		t.Errorf(`expected 304 for the ETag we sent, got %v`, w.Code)
+	}
+}
+
+func TestCanaryStickiness(t *testing.T) {
+	all, none := 100, 0
+	canary := &cfg.CanarySettings{Release: `v2`, Percent: &all}
+	cfg.Config = &cfg.AppConfig{
+		Projects: map[string]cfg.ProjectSettings{`docs`: {Release: `v1`, Canary: canary}},
+		Login:    cfg.LoginSettings{RedirectURL: `https://sites.example.com/auth/callback`},
+	}
+	newTestContainer(t, map[string][]byte{
+		`releases/docs/v1.tar.gz`: makeSite(t, map[string]string{`index.html`: `v1`}),
+		`releases/docs/v2.tar.gz`: makeSite(t, map[string]string{`index.html`: `v2`}),
+	})
+	g := newTestEngine()
+	cookieName := releaseCookiePrefix + `docs`
+
+	// a new visitor goes to the canary, and is pinned to it
+	w := get(g, `/docs/`)
+	if w.Body.String() != `v2` {
+		t.Errorf(`expected the canary, got %q`, w.Body.String())
+	}
+	cookie := w.Header().Get(`Set-Cookie`)
+	if !strings.HasPrefix(cookie, cookieName+`=v2`) || !strings.Contains(cookie, `Secure`) || !strings.Contains(cookie, `HttpOnly`) {
+		t.Errorf(`expected a secure cookie pinning the canary, got %q`, cookie)
+	}
+
+	// visitors keep the release they were given, whatever the roll
+	canary.Percent = &none
+	if w := get(g, `/docs/`, `Cookie`, cookieName+`=v2`); w.Body.String() != `v2` || w.Header().Get(`Set-Cookie`) != `` {
+		t.Errorf(`expected a visitor pinned to the canary to keep it, got %q`, w.Body.String())
+	}
+	if w := get(g, `/docs/`); w.Body.String() != `v1` {
+		t.Errorf(`expected a new visitor to get the stable release with no canary traffic, got %q`, w.Body.String())
+	}
+	canary.Percent = &all
+	if w := get(g, `/docs/`, `Cookie`, cookieName+`=v1`); w.Body.String() != `v1` {
+		t.Errorf(`expected a visitor pinned to the stable release to keep it, got %q`, w.Body.String())
+	}
+
+	// a cookie for a release that isn't in the rollout is rolled again
+	if w := get(g, `/docs/`, `Cookie`, cookieName+`=v0`); w.Body.String() != `v2` || !strings.HasPrefix(w.Header().Get(`Set-Cookie`), cookieName+`=v2`) {
+		t.Errorf(`expected a stale pin to be replaced, got %q`, w.Body.String())
+	}
+
+	if counts := releaseDiagnostics()[`docs`]; counts[`v1`] == nil || counts[`v2`] == nil {
+		t.Errorf(`expected requests counted for both releases, got %v`, counts)
+	}
+}
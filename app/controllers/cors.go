@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	enum "github.com/elephant-insurance/enumerations/v2"
+	mscors "github.com/elephant-insurance/go-microservice-arch/v2/cors"
+	"github.com/elephant-insurance/go-microservice-arch/v2/log"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// globalCORS is the handler for the CORS settings of RequiredConfig, for everything without a policy of its own
+	globalCORS gin.HandlerFunc
+
+	// corsHandlers holds a handler for each project CORS policy we have seen, by corsKey
+	corsHandlers sync.Map
+)
+
+// CORS applies the CORS policy of the project a request is for or, for projects without one and our own endpoints, global.
+// A project's policy may come from its site manifest, so documents get it from HandleGetDocument once the site is loaded;
+// preflight requests, which no handler answers, get it here.
+func CORS(global gin.HandlerFunc) gin.HandlerFunc {
+	globalCORS = global
+
+	return func(c *gin.Context) {
+		project := requestProject(c)
+		if project == `` {
+			global(c)
+			return
+		}
+		if c.Request.Method == http.MethodOptions {
+			applyCORS(c, project, preflightPolicy(c, project))
+		}
+	}
+}
+
+// applyCORS applies the CORS policy of project, with manifestPolicy from its site manifest if it has one.
+// It returns false if the request is from an origin that may not use the project, and has been turned away.
+func applyCORS(c *gin.Context, project string, manifestPolicy *cfg.CORSPolicy) bool {
+	handler := globalCORS
+	if policy := cfg.Config.CORSFor(project, manifestPolicy); policy != nil {
+		handler = corsHandler(policy)
+	}
+	if handler != nil {
+		handler(c)
+	}
+
+	return !c.IsAborted()
+}
+
+// preflightPolicy returns the CORS policy in the site manifest of project, loading the site if it isn't cached
+func preflightPolicy(c *gin.Context, project string) *cfg.CORSPolicy {
+	if c.GetHeader(`Origin`) == `` || cfg.Config.ForProject(project).Mode == cfg.ModeBlob {
+		// not a CORS request, or a project without a site manifest
+		return nil
+	}
+	snap, _, err := loadArchive(c, project, stableRelease(c, project))
+	if err != nil || snap == nil {
+		return nil
+	}
+
+	return snap.Manifest.CORS
+}
+
+// corsHandler returns the handler for policy, making it the first time the policy is seen
+func corsHandler(policy *cfg.CORSPolicy) gin.HandlerFunc {
+	key := corsKey(policy)
+	if handler, found := corsHandlers.Load(key); found {
+		return handler.(gin.HandlerFunc)
+	}
+	handler, _ := corsHandlers.LoadOrStore(key, newCORSHandler(policy))
+
+	return handler.(gin.HandlerFunc)
+}
+
+// newCORSHandler makes a handler for policy, over the CORS settings of RequiredConfig
+func newCORSHandler(policy *cfg.CORSPolicy) gin.HandlerFunc {
+	rc := cfg.Config.RequiredConfig
+	config := cors.Config{
+		AllowOrigins:     rc.GetAllowedOrigins(),
+		AllowHeaders:     append(standardCORSHeaders(), rc.GetAllowedHeaders()...),
+		ExposeHeaders:    append([]string{mscors.ExposeHeaderContentLength, mscors.ExposeHeaderDate, `ETag`}, rc.GetExposedHeaders()...),
+		AllowCredentials: true,
+		AllowWildcard:    true,
+	}
+	methods := rc.GetAllowedMethods()
+	if len(policy.Methods) > 0 {
+		methods = policy.Methods
+	}
+	config.AllowMethods = append([]string{http.MethodGet, http.MethodHead, http.MethodOptions}, methods...)
+	if len(policy.Headers) > 0 {
+		config.AllowHeaders = append(standardCORSHeaders(), policy.Headers...)
+	}
+	if policy.MaxAgeSeconds != nil {
+		config.MaxAge = time.Duration(*policy.MaxAgeSeconds) * time.Second
+	}
+	if len(policy.Origins) > 0 {
+		config.AllowOrigins = policy.Origins
+	}
+	if len(config.AllowOrigins) == 1 && config.AllowOrigins[0] == cfg.CORSOff {
+		config.AllowOrigins = nil
+		config.AllowOriginFunc = func(string) bool { return false }
+	}
+	err := cfg.CheckCORSPolicy(policy)
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		// the policy should have been checked when it was loaded; let no other origin in rather than any
+		log.ForFunc(context.Background()).WithError(err).Error("invalid CORS policy")
+		config = cors.Config{AllowOriginFunc: func(string) bool { return false }}
+	}
+
+	return cors.New(config)
+}
+
+// standardCORSHeaders are the request headers the global CORS settings always allow
+func standardCORSHeaders() []string {
+	return []string{
+		mscors.AcceptHeaderXRequestedWith,
+		mscors.AcceptHeaderOrigin,
+		mscors.AcceptHeaderContentType,
+		mscors.AcceptHeaderAccept,
+		mscors.AcceptHeaderXAuthToken,
+		mscors.AcceptHeaderXAPIVersionToken,
+		mscors.AcceptHeaderAuthorization,
+		enum.TXHeader.Brand.HeaderKey,
+		enum.TXHeader.Domain.HeaderKey,
+		enum.TXHeader.ID.HeaderKey,
+		enum.TXHeader.Integrator.HeaderKey,
+		enum.TXHeader.Source.HeaderKey,
+		enum.TXHeader.Type.HeaderKey,
+		enum.TXHeader.IPAddress.HeaderKey,
+		enum.TXHeader.Instance.HeaderKey,
+	}
+}
+
+// corsKey identifies a policy, so that projects with the same policy share a handler
+func corsKey(policy *cfg.CORSPolicy) string {
+	maxAge := `-`
+	if policy.MaxAgeSeconds != nil {
+		maxAge = fmt.Sprint(*policy.MaxAgeSeconds)
+	}
+
+	return strings.Join([]string{strings.Join(policy.Origins, `,`), strings.Join(policy.Methods, `,`), strings.Join(policy.Headers, `,`), maxAge}, `|`)
+}
@@ -0,0 +1,38 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+	"github.com/elephant-insurance/ms-sites/app/services"
+	"github.com/gin-gonic/gin"
+)
+
+func TestCORS(t *testing.T) {
+	cfg.Config = &cfg.AppConfig{
+		Projects: map[string]cfg.ProjectSettings{`widgets`: {CORS: &cfg.CORSSettings{Origins: `https://quote.example.com`}}},
+	}
+	newTestContainer(t, map[string][]byte{`widgets.tar.gz`: makeSite(t, map[string]string{`index.html`: `widget`})})
+	// in the order main uses them
+	g := newTestEngine(SecurityHeaders(), RateLimit(), CORS(func(*gin.Context) {}))
+
+	w := get(g, `/widgets/`, `Origin`, `https://quote.example.com`)
+	if w.Code != http.StatusOK || w.Header().Get(`Access-Control-Allow-Origin`) != `https://quote.example.com` {
+		t.Errorf(`expected the allowed origin to get the document, got %v with %q`, w.Code, w.Header().Get(`Access-Control-Allow-Origin`))
+	}
+	if w := get(g, `/widgets/`, `Origin`, `https://evil.example.com`); w.Code != http.StatusForbidden || w.Body.String() == `widget` {
+		t.Errorf(`expected another origin to be turned away, got %v`, w.Code)
+	}
+	if w := get(g, `/widgets/`); w.Code != http.StatusOK {
+		t.Errorf(`expected a request without an origin to get the document, got %v`, w.Code)
+	}
+
+	w = send(g, http.MethodOptions, `/widgets/`, `Origin`, `https://quote.example.com`, `Access-Control-Request-Method`, `GET`)
+	if w.Code != http.StatusNoContent || w.Header().Get(`Access-Control-Allow-Origin`) != `https://quote.example.com` {
+		t.Errorf(`expected the preflight to be answered, got %v with %q`, w.Code, w.Header().Get(`Access-Control-Allow-Origin`))
+	}
+	if w.Header().Get(services.HeaderContentTypeOptions) == `` {
+		t.Error(`expected the preflight to get the security headers`)
+	}
+}
@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/bc"
+	"github.com/elephant-insurance/go-microservice-arch/v2/log"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+	"github.com/elephant-insurance/ms-sites/app/services"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// eventKeyHeader carries the event key, which the subscription sends as a delivery header;
+	// never the URL, which ends up in access logs
+	eventKeyHeader = `X-Event-Key`
+	// Event Grid delivers at most 1MB of events at a time
+	maxEventBatchBytes = 1 << 20
+)
+
+// validationResponse confirms an Event Grid subscription
+type validationResponse struct {
+	ValidationResponse string `json:"validationResponse"`
+}
+
+// HandleStorageEvents accepts a batch of Azure Event Grid events about the container, in the Event Grid schema,
+// and purges or refreshes the projects they touch.
+// It answers the handshake Event Grid sends when the subscription is created.
+func HandleStorageEvents(c *gin.Context) {
+	lw := log.ForFunc(c).Debug(`called`)
+	if !checkKey(c, cfg.Config.Events.Key, eventKeyHeader) {
+		lw.Warn("storage event with a bad key")
+		return
+	}
+
+	events := []services.StorageEvent{}
+	if err := json.NewDecoder(http.MaxBytesReader(c.Writer, c.Request.Body, maxEventBatchBytes)).Decode(&events); err != nil {
+		lw.WithError(err).Warn("error reading storage events")
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	outcomes := make([]services.EventOutcome, 0, len(events))
+	for _, event := range events {
+		if event.EventType == services.EventSubscriptionValidation {
+			lw.SetName(event.Topic).Info("storage event subscription validated")
+			bc.RenderJSONResponse(c, http.StatusOK, validationResponse{ValidationResponse: event.ValidationCode()})
+			return
+		}
+		outcome := services.Blob.HandleStorageEvent(c, event)
+		if outcome.Action != services.EventIgnored {
+			services.NotifyPeersOfEvent(event)
+		}
+		outcomes = append(outcomes, outcome)
+	}
+
+	bc.RenderJSONResponse(c, http.StatusOK, outcomes)
+}
+
+// checkKey makes sure the request carries key in the header named keyHeader.
+// If it doesn't, or no key is configured, it sends the error status and returns false.
+func checkKey(c *gin.Context, key, keyHeader string) bool {
+	if key == `` {
+		c.Status(http.StatusNotFound)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(c.GetHeader(keyHeader)), []byte(key)) != 1 {
+		c.Status(http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckKey(t *testing.T) {
+	g := gin.New()
+	g.POST(`/keyed`, func(c *gin.Context) {
+		if checkKey(c, `secret`, eventKeyHeader) {
+			c.Status(http.StatusNoContent)
+		}
+	})
+	g.POST(`/unkeyed`, func(c *gin.Context) {
+		if checkKey(c, ``, eventKeyHeader) {
+			c.Status(http.StatusNoContent)
+		}
+	})
+
+	tests := []struct {
+		label   string
+		url     string
+		headers []string
+		status  int
+	}{
+		{`key header`, `/keyed`, []string{eventKeyHeader, `secret`}, http.StatusNoContent},
+		{`wrong key`, `/keyed`, []string{eventKeyHeader, `guess`}, http.StatusUnauthorized},
+		{`key in the URL`, `/keyed?key=secret`, nil, http.StatusUnauthorized},
+		{`no key configured`, `/unkeyed`, []string{eventKeyHeader, ``}, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if w := send(g, http.MethodPost, test.url, test.headers...); w.Code != test.status {
+			t.Errorf(`%v: got %v, expected %v`, test.label, w.Code, test.status)
+		}
+	}
+}
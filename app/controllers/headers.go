@@ -0,0 +1,30 @@
+package controllers
+
+import (
+	"strings"
+
+	"github.com/elephant-insurance/ms-sites/app/services"
+	"github.com/gin-gonic/gin"
+)
+
+// SecurityHeaders adds the security headers of the project a request is for, or our own, to every response.
+// They are set before the handler runs, so that a handler can still make one stricter for a particular response.
+func SecurityHeaders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		project := requestProject(c)
+		for header, value := range services.SecurityHeaders(project) {
+			c.Header(header, value)
+		}
+		c.Next()
+	}
+}
+
+// requestProject returns the project a request is for, from the first segment of its path, or empty if it isn't for one
+func requestProject(c *gin.Context) string {
+	project, _, _ := strings.Cut(strings.TrimPrefix(c.Request.URL.Path, `/`), `/`)
+	if !services.ValidProjectName(project) {
+		return ``
+	}
+
+	return project
+}
@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/log"
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+	"github.com/elephant-insurance/go-microservice-arch/v2/sec"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+	"github.com/elephant-insurance/ms-sites/app/services"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// loginPath is where browsers are sent to sign in; routes registers the same path
+	loginPath = `/auth/login`
+	// loginFlowPath limits the login state cookie to the login endpoints
+	loginFlowPath = `/auth`
+)
+
+// HandleLogin sends the browser to the identity provider to sign in, remembering where it should come back to
+func HandleLogin(c *gin.Context) {
+	lw := log.ForFunc(c).Debug(`called`)
+	if !cfg.Config.LoginEnabled() {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	authURL, flow, err := services.StartLogin(c.Query("return"))
+	if err != nil {
+		lw.WithError(err).Error("error starting login")
+		c.Header("Retry-After", retryAfterSeconds)
+		c.Status(http.StatusServiceUnavailable)
+		return
+	}
+	setCookie(c, services.LoginCookieName, flow, loginFlowPath, services.LoginFlowSeconds)
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// HandleLoginCallback is where the identity provider sends the browser back to.
+// It starts a session and sends the browser on to where it was going when it had to sign in.
+func HandleLoginCallback(c *gin.Context) {
+	lw := log.ForFunc(c).Debug(`called`)
+	if !cfg.Config.LoginEnabled() {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+
+	flow, _ := c.Cookie(services.LoginCookieName)
+	setCookie(c, services.LoginCookieName, ``, loginFlowPath, -1)
+	if idpError := c.Query("error"); idpError != `` {
+		lw.WithConsoleField("error", idpError).Warn("identity provider refused login")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not Authorized"})
+		return
+	}
+
+	session, returnTo, err := services.FinishLogin(c, flow, c.Query("state"), c.Query("code"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not Authorized"})
+		return
+	}
+	sealed, err := services.SealSession(session)
+	if err != nil {
+		lw.WithError(err).Error("error sealing session")
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	setCookie(c, services.SessionCookieName, sealed, `/`, int(time.Until(time.Unix(session.Expires, 0)).Seconds()))
+	lw.SetName(session.Subject).Info("signed in")
+	c.Redirect(http.StatusFound, returnTo)
+}
+
+// HandleLogout ends the browser's session, and its session with the identity provider if it tells us how
+func HandleLogout(c *gin.Context) {
+	log.ForFunc(c).Debug(`called`)
+	if !cfg.Config.LoginEnabled() {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	setCookie(c, services.SessionCookieName, ``, `/`, -1)
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(http.StatusFound, services.LogoutURL(c.Query("return")))
+}
+
+// sessionAllowed lets in a browser that has signed in, and makes its session the request's access token
+func sessionAllowed(c *gin.Context) bool {
+	value, err := c.Cookie(services.SessionCookieName)
+	if err != nil {
+		return false
+	}
+	session := services.OpenSession(value)
+	if session == nil {
+		return false
+	}
+	setAccessToken(c, session.AccessToken())
+
+	return true
+}
+
+// loginRedirect sends a browser with no credentials to sign in, if login is configured, and reports whether it did.
+// API clients, and anyone who sent a token, get a 401 instead.
+func loginRedirect(c *gin.Context) bool {
+	if !cfg.Config.LoginEnabled() || c.Request.Method != http.MethodGet || c.GetHeader(sec.AuthHeaderKey) != `` ||
+		!strings.Contains(c.GetHeader("Accept"), "text/html") {
+		return false
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(http.StatusFound, loginPath+`?`+url.Values{"return": {c.Request.URL.RequestURI()}}.Encode())
+	c.Abort()
+
+	return true
+}
+
+// setAccessToken puts token where sec.TokenFromContext looks for it
+func setAccessToken(c *gin.Context, token sec.AccessToken) {
+	key := sec.ContextKeyAccessToken
+	msrqc.NamespaceSet(c, &msrqc.NamespaceKeySec, &key, token, true)
+}
+
+func setCookie(c *gin.Context, name, value, path string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(name, value, maxAge, path, ``, services.SecureCookies(), true)
+}
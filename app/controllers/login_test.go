@@ -0,0 +1,55 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+	"github.com/elephant-insurance/ms-sites/app/services"
+)
+
+// sessionCookie returns a Cookie header value holding a login session with roles
+func sessionCookie(t *testing.T, roles ...string) string {
+	sealed, err := services.SealSession(&services.Session{Subject: `agent`, Roles: roles, Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return services.SessionCookieName + `=` + sealed
+}
+
+func TestLoginSessionAccess(t *testing.T) {
+	cfg.Config = &cfg.AppConfig{
+		Projects: map[string]cfg.ProjectSettings{`staff`: {Access: cfg.AccessLogin}},
+		Login:    cfg.LoginSettings{Issuer: `https://idp.invalid`, SessionKey: `test-session-key`},
+	}
+	newTestContainer(t, map[string][]byte{`staff.tar.gz`: makeSite(t, map[string]string{`index.html`: `home`})})
+	g := newTestEngine()
+
+	tests := []struct {
+		label   string
+		headers []string
+		status  int
+	}{
+		{`no session`, nil, http.StatusUnauthorized},
+		{`browser without a session`, []string{`Accept`, `text/html`}, http.StatusFound},
+		{`bad session`, []string{`Cookie`, services.SessionCookieName + `=forged`}, http.StatusUnauthorized},
+		{`session`, []string{`Cookie`, sessionCookie(t)}, http.StatusOK},
+	}
+	for _, test := range tests {
+		w := get(g, `/staff/`, test.headers...)
+		if w.Code != test.status {
+			t.Errorf(`%v: got %v, expected %v`, test.label, w.Code, test.status)
+		}
+		if w.Code != http.StatusOK && w.Body.String() == `home` {
+			t.Errorf(`%v: document sent with %v`, test.label, w.Code)
+		}
+		if w.Code == http.StatusOK && w.Header().Get(`Cache-Control`) != `private` {
+			t.Errorf(`%v: protected document not marked private`, test.label)
+		}
+	}
+	if w := get(g, `/staff/`, `Accept`, `text/html`); w.Header().Get(`Location`) != loginPath+`?return=%2Fstaff%2F` {
+		t.Errorf(`expected a browser to be sent to sign in, got %q`, w.Header().Get(`Location`))
+	}
+}
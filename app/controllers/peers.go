@@ -0,0 +1,42 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/bc"
+	"github.com/elephant-insurance/go-microservice-arch/v2/log"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+	"github.com/elephant-insurance/ms-sites/app/services"
+	"github.com/gin-gonic/gin"
+)
+
+// peerResult is what we send back to a replica that has told us about invalidations
+type peerResult struct {
+	Applied int `json:"applied"`
+}
+
+// HandlePeerInvalidate applies the invalidations another replica sends us, as a JSON array
+func HandlePeerInvalidate(c *gin.Context) {
+	lw := log.ForFunc(c).Debug(`called`)
+	if !checkKey(c, cfg.Config.Peers.Key, services.PeerKeyHeader) {
+		lw.Warn("peer invalidation with a bad key")
+		return
+	}
+
+	invalidations := []services.Invalidation{}
+	if err := json.NewDecoder(http.MaxBytesReader(c.Writer, c.Request.Body, maxEventBatchBytes)).Decode(&invalidations); err != nil {
+		lw.WithError(err).Warn("error reading peer invalidations")
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	result := peerResult{}
+	for _, inv := range invalidations {
+		if services.Blob.ApplyInvalidation(c, inv) {
+			result.Applied++
+		}
+	}
+
+	bc.RenderJSONResponse(c, http.StatusOK, result)
+}
@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/bc"
+	"github.com/elephant-insurance/go-microservice-arch/v2/log"
+	"github.com/elephant-insurance/ms-sites/app/services"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// uploadFormField is the multipart form field holding the archive, when the upload is a form post
+	uploadFormField = `archive`
+	// releaseTimeFormat names releases published without an explicit name
+	releaseTimeFormat = `20060102T150405Z`
+)
+
+// publishResult is what we send back from the publish and activate endpoints
+type publishResult struct {
+	Project string                  `json:"project"`
+	Release string                  `json:"release"`
+	Active  bool                    `json:"active"`
+	Error   string                  `json:"error,omitempty"`
+	Report  *services.ArchiveReport `json:"report,omitempty"`
+}
+
+// HandlePublish accepts a site archive, either as the raw request body or as the "archive" field of a form,
+// checks it, and stores it as a new release of the project.
+// The release name comes from the path, or the "release" query parameter, or the current time.
+// If the "activate" query parameter is true, the new release is also made the one we serve.
+func HandlePublish(c *gin.Context) {
+	lw := log.ForFunc(c).Debug(`called`)
+	project := c.Param("project")
+	release := c.Param("release")
+	if release == `` {
+		release = c.Query("release")
+	}
+	if release == `` {
+		release = time.Now().UTC().Format(releaseTimeFormat)
+	}
+	result := publishResult{Project: project, Release: release}
+	defer func() { services.Audit(c, services.AuditPublish, project, release, c.Writer.Status(), result.Error) }()
+
+	if !services.ValidProjectName(project) || !services.ValidReleaseName(release) {
+		result.Error = `invalid project or release name`
+		bc.RenderJSONResponse(c, http.StatusBadRequest, result)
+		return
+	}
+
+	archive, err := readUpload(c)
+	if err != nil {
+		lw.WithError(err).Warn("error reading upload")
+		result.Error = err.Error()
+		status := http.StatusBadRequest
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		bc.RenderJSONResponse(c, status, result)
+		return
+	}
+
+	result.Report = services.ValidateArchive(c, project, bytes.NewReader(archive))
+	if !result.Report.Valid {
+		result.Error = `archive failed validation`
+		status := http.StatusUnprocessableEntity
+		if result.Report.Limit != nil {
+			result.Error = result.Report.Limit.Error()
+			status = http.StatusRequestEntityTooLarge
+		}
+		bc.RenderJSONResponse(c, status, result)
+		return
+	}
+
+	if status, err := services.Blob.UploadRelease(c, project, release, services.DetectFormat(``, archive), archive); err != nil {
+		result.Error = `failed to store release`
+		bc.RenderJSONResponse(c, status, result)
+		return
+	}
+	services.NotifyPeers(services.PeerDrop, project, release)
+
+	if activate, _ := strconv.ParseBool(c.Query("activate")); activate {
+		if status, err := services.Blob.ActivateRelease(c, project, release); err != nil {
+			result.Error = `release stored but not activated`
+			services.Audit(c, services.AuditActivate, project, release, status, err.Error())
+			bc.RenderJSONResponse(c, status, result)
+			return
+		}
+		services.Audit(c, services.AuditActivate, project, release, http.StatusOK, ``)
+		services.NotifyPeers(services.PeerActivate, project, release)
+		result.Active = true
+	}
+
+	lw.SetName(project).Info("release published: " + release)
+	bc.RenderJSONResponse(c, http.StatusCreated, result)
+}
+
+// HandleActivate makes an existing release the one we serve for its project
+func HandleActivate(c *gin.Context) {
+	lw := log.ForFunc(c).Debug(`called`)
+	project := c.Param("project")
+	release := c.Param("release")
+	result := publishResult{Project: project, Release: release}
+	defer func() { services.Audit(c, services.AuditActivate, project, release, c.Writer.Status(), result.Error) }()
+
+	if !services.ValidProjectName(project) || !services.ValidReleaseName(release) {
+		result.Error = `invalid project or release name`
+		bc.RenderJSONResponse(c, http.StatusBadRequest, result)
+		return
+	}
+
+	if status, err := services.Blob.ActivateRelease(c, project, release); err != nil {
+		result.Error = `failed to activate release`
+		bc.RenderJSONResponse(c, status, result)
+		return
+	}
+	services.NotifyPeers(services.PeerActivate, project, release)
+
+	result.Active = true
+	lw.SetName(project).Info("release activated: " + release)
+	bc.RenderJSONResponse(c, http.StatusOK, result)
+}
+
+// readUpload returns the archive sent with the request, up to the configured compressed size limit
+func readUpload(c *gin.Context) ([]byte, error) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, services.MaxCompressedBytes())
+
+	if strings.HasPrefix(c.ContentType(), `multipart/form-data`) {
+		fh, err := c.FormFile(uploadFormField)
+		if err != nil {
+			return nil, err
+		}
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		return io.ReadAll(f)
+	}
+
+	archive, err := io.ReadAll(c.Request.Body)
+	if err == nil && len(archive) == 0 {
+		err = errors.New(`no archive in request`)
+	}
+
+	return archive, err
+}
@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/log"
+	"github.com/elephant-insurance/ms-sites/app/services"
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimit turns away requests from clients, or for projects, that have used up their rate limits
+func RateLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		project := requestProject(c)
+		if err := services.AllowRequest(services.ClientIP(c.Request), project); err != nil {
+			tooManyRequests(c, err)
+			return
+		}
+		c.Next()
+	}
+}
+
+// tooManyRequests sends 429, saying when to try again if err is a RateLimitError
+func tooManyRequests(c *gin.Context, err error) {
+	retryAfter := 1
+	var limited *services.RateLimitError
+	if errors.As(err, &limited) {
+		retryAfter = int(math.Max(1, math.Ceil(limited.RetryAfter.Seconds())))
+	}
+	log.ForFunc(c).WithError(err).WithConsoleField("ip", services.ClientIP(c.Request).String()).Debug("rate limited")
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too Many Requests"})
+}
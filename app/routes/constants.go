@@ -1,8 +1,39 @@
 package routes
 
 const (
-	pathGetDocument      string = `/:project/:document`
+	pathGetDocument      string = `/:project/*document`
 	routeNameGetDocument string = `get document`
 	pathGetIndex         string = `/:project`
 	routeNameGetIndex    string = `get index`
+
+	pathPublish         string = `/publish/:project`
+	pathPublishRelease  string = `/publish/:project/:release`
+	pathActivateRelease string = `/publish/:project/:release/activate`
+	routeNamePublish    string = `publish`
+	routeNameActivate   string = `activate release`
+
+	pathAdminCache        string = `/admin/cache`
+	pathAdminCacheProject string = `/admin/cache/:project`
+	pathAdminCacheRefresh string = `/admin/cache/:project/refresh`
+	routeNameListCache    string = `list cache`
+	routeNameShowCache    string = `show cached project`
+	routeNamePurgeCache   string = `purge cache`
+	routeNameRefreshCache string = `refresh cached project`
+	pathAdminSign         string = `/admin/sign`
+	routeNameSignURL      string = `sign url`
+	pathAdminAudit        string = `/admin/audit`
+	routeNameListAudit    string = `list audit`
+
+	pathStorageEvents      string = `/events/storage`
+	routeNameStorageEvents string = `storage events`
+
+	pathPeerInvalidate      string = `/peers/invalidate`
+	routeNamePeerInvalidate string = `peer invalidate`
+
+	pathLogin         string = `/auth/login`
+	pathLoginCallback string = `/auth/callback`
+	pathLogout        string = `/auth/logout`
+	routeNameLogin    string = `login`
+	routeNameCallback string = `login callback`
+	routeNameLogout   string = `logout`
 )
@@ -8,6 +8,7 @@ import (
 	"github.com/elephant-insurance/go-microservice-arch/v2/cfg"
 	"github.com/elephant-insurance/go-microservice-arch/v2/log"
 	"github.com/elephant-insurance/go-microservice-arch/v2/routes"
+	"github.com/elephant-insurance/go-microservice-arch/v2/sec"
 	c "github.com/elephant-insurance/ms-sites/app/controllers"
 )
 
@@ -19,8 +20,36 @@ func Initialize(requiredConfig cfg.Configurator, g *gin.Engine) *routes.Router {
 
 	appRouter = routes.New(requiredConfig, g)
 
+	// admin routes first, so that they aren't taken for documents
+	appRouter.GET(routeNameListCache, pathAdminCache, authorized(c.HandleListCache))
+	appRouter.GET(routeNameShowCache, pathAdminCacheProject, authorized(c.HandleShowCache))
+	appRouter.DELETE(routeNamePurgeCache, pathAdminCache, authorized(c.HandlePurgeCache))
+	appRouter.DELETE(routeNamePurgeCache, pathAdminCacheProject, authorized(c.HandlePurgeCache))
+	appRouter.POST(routeNameRefreshCache, pathAdminCacheRefresh, authorized(c.HandleRefreshCache))
+	appRouter.POST(routeNameSignURL, pathAdminSign, authorized(c.HandleSignURL))
+	appRouter.GET(routeNameListAudit, pathAdminAudit, authorized(c.HandleListAudit))
+
+	// Event Grid can't log in, so storage events carry their own key
+	appRouter.POST(routeNameStorageEvents, pathStorageEvents, c.HandleStorageEvents)
+	appRouter.POST(routeNamePeerInvalidate, pathPeerInvalidate, c.HandlePeerInvalidate)
+
+	// browser login for sites that need it
+	appRouter.GET(routeNameLogin, pathLogin, c.HandleLogin)
+	appRouter.GET(routeNameCallback, pathLoginCallback, c.HandleLoginCallback)
+	appRouter.GET(routeNameLogout, pathLogout, c.HandleLogout)
+	appRouter.POST(routeNameLogout, pathLogout, c.HandleLogout)
+
 	appRouter.GET(routeNameGetDocument, pathGetDocument, c.HandleGetDocument)
 	appRouter.GET(routeNameGetDocument, pathGetIndex, c.HandleGetDocument)
 
+	appRouter.POST(routeNamePublish, pathPublish, authorized(c.HandlePublish))
+	appRouter.POST(routeNameActivate, pathActivateRelease, authorized(c.HandleActivate))
+	appRouter.PUT(routeNamePublish, pathPublishRelease, authorized(c.HandlePublish))
+
 	return appRouter
 }
+
+// authorized guards handler with sec, turning away requests without credentials first, since sec lets them through in Okta mode
+func authorized(handler gin.HandlerFunc) gin.HandlerFunc {
+	return c.RequireCredentials(sec.AuthorizeUserForHandler(handler))
+}
@@ -1,23 +1,50 @@
 package routes
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/elephant-insurance/go-microservice-arch/v2/cfg"
 	"github.com/elephant-insurance/go-microservice-arch/v2/routes"
+	"github.com/elephant-insurance/go-microservice-arch/v2/sec"
+	appcfg "github.com/elephant-insurance/ms-sites/app/cfg"
+	"github.com/elephant-insurance/ms-sites/app/services"
 
 	enum "github.com/elephant-insurance/enumerations/v2"
 
 	"github.com/gin-gonic/gin"
 )
 
-var routeTests = []routes.RouteTest{}
+var routeTests = []routes.RouteTest{
+	{Method: http.MethodGet, URL: `/docs`, ExpectedRoute: routeNameGetDocument, ExpectedParams: map[string]string{`project`: `docs`}},
+	{Method: http.MethodGet, URL: `/docs/guide/css/site.css`, ExpectedRoute: routeNameGetDocument, ExpectedParams: map[string]string{`project`: `docs`, `document`: `guide/css/site.css`}},
+	{Method: http.MethodPost, URL: `/publish/docs`, ExpectedRoute: routeNamePublish, ExpectedParams: map[string]string{`project`: `docs`}},
+	{Method: http.MethodPut, URL: `/publish/docs/v2`, ExpectedRoute: routeNamePublish, ExpectedParams: map[string]string{`project`: `docs`, `release`: `v2`}},
+	{Method: http.MethodPost, URL: `/publish/docs/v2/activate`, ExpectedRoute: routeNameActivate, ExpectedParams: map[string]string{`release`: `v2`}},
+	{Method: http.MethodGet, URL: `/admin/cache`, ExpectedRoute: routeNameListCache},
+	{Method: http.MethodGet, URL: `/admin/cache/docs`, ExpectedRoute: routeNameShowCache, ExpectedParams: map[string]string{`project`: `docs`}},
+	{Method: http.MethodDelete, URL: `/admin/cache`, ExpectedRoute: routeNamePurgeCache},
+	{Method: http.MethodDelete, URL: `/admin/cache/docs`, ExpectedRoute: routeNamePurgeCache, ExpectedParams: map[string]string{`project`: `docs`}},
+	{Method: http.MethodPost, URL: `/admin/cache/docs/refresh`, ExpectedRoute: routeNameRefreshCache, ExpectedParams: map[string]string{`project`: `docs`}},
+	{Method: http.MethodPost, URL: `/admin/sign`, ExpectedRoute: routeNameSignURL},
+	{Method: http.MethodGet, URL: `/admin/audit?project=docs`, ExpectedRoute: routeNameListAudit},
+	{Method: http.MethodPost, URL: `/events/storage`, ExpectedRoute: routeNameStorageEvents},
+	{Method: http.MethodPost, URL: `/peers/invalidate`, ExpectedRoute: routeNamePeerInvalidate},
+	{Method: http.MethodGet, URL: `/auth/login?return=/docs/`, ExpectedRoute: routeNameLogin},
+	{Method: http.MethodGet, URL: `/auth/callback?code=abc&state=xyz`, ExpectedRoute: routeNameCallback},
+	{Method: http.MethodPost, URL: `/auth/logout`, ExpectedRoute: routeNameLogout},
+}
 
 func TestRoutes(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	g := gin.New()
 	rc := cfg.RequiredConfig{
-		Environment: enum.ServiceEnvironment.Testing.ID,
+		AllowedMethods: `GET,POST,PUT,DELETE`,
+		Environment:    enum.ServiceEnvironment.Testing.ID,
 	}
 	testRC := cfg.NewTestConfigurator(rc)
 	r := Initialize(testRC, g)
@@ -27,3 +54,108 @@ func TestRoutes(t *testing.T) {
 		thisTest.Run(r, g, t)
 	}
 }
+
+// TestDocumentRoute sends requests through the document routes to HandleGetDocument, with a stub container behind it
+func TestDocumentRoute(t *testing.T) {
+	// in test mode the router only picks a route; handlers run in release mode
+	gin.SetMode(gin.ReleaseMode)
+	defer gin.SetMode(gin.TestMode)
+	defer func() { appcfg.Config = nil; services.Blob = nil; services.Purge(`routed`) }()
+	appcfg.Config = &appcfg.AppConfig{}
+
+	archive := makeTarGz(t, map[string]string{`index.html`: `home`, `guide/index.html`: `guide`, `guide/site.css`: `css`})
+	container := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != `/sites/sites/routed.tar.gz` {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set(`ETag`, `"1"`)
+		w.Write(archive)
+	}))
+	defer container.Close()
+	services.Blob = services.NewBlobServiceAt(container.URL, `sites`, ``, `sites`)
+
+	g := gin.New()
+	rc := cfg.RequiredConfig{AllowedMethods: `GET,POST,PUT,DELETE`, Environment: enum.ServiceEnvironment.Testing.ID}
+	testRC := cfg.NewTestConfigurator(rc)
+	Initialize(testRC, g).FinalizeForTest(testRC)
+
+	for _, test := range []struct {
+		url    string
+		status int
+		body   string
+	}{
+		{`/routed`, http.StatusOK, `home`},
+		{`/routed/`, http.StatusOK, `home`},
+		{`/routed/guide/`, http.StatusOK, `guide`},
+		{`/routed/guide/index.html`, http.StatusOK, `guide`},
+		{`/routed/guide/site.css`, http.StatusOK, `css`},
+		{`/routed//guide/site.css`, http.StatusBadRequest, ``},
+		{`/routed/guide/../index.html`, http.StatusBadRequest, ``},
+		{`/routed/missing.html`, http.StatusNotFound, ``},
+	} {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.url, nil))
+		if w.Code != test.status || (test.body != `` && w.Body.String() != test.body) {
+			t.Errorf(`%v: got %v %q, expected %v %q`, test.url, w.Code, w.Body.String(), test.status, test.body)
+		}
+	}
+}
+
+// TestAuthorizedRoutesNeedCredentials checks that, with sec in Okta mode, requests without a token sec will check never reach the handlers
+func TestAuthorizedRoutesNeedCredentials(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	defer gin.SetMode(gin.TestMode)
+	defer func() { appcfg.Config = nil }()
+	okta := sec.Settings{OktaBaseAddress: `https://okta.invalid`, OktaClientID: `ms-sites`}
+	appcfg.Config = &appcfg.AppConfig{Security: okta}
+
+	g := gin.New()
+	rc := cfg.RequiredConfig{AllowedMethods: `GET,POST,PUT,DELETE`, Environment: enum.ServiceEnvironment.Testing.ID}
+	testRC := cfg.NewTestConfigurator(rc)
+	sec.Initialize(testRC, &okta)
+	Initialize(testRC, g).FinalizeForTest(testRC)
+
+	for _, test := range []struct{ method, url string }{
+		{http.MethodGet, `/admin/cache`},
+		{http.MethodGet, `/admin/cache/docs`},
+		{http.MethodDelete, `/admin/cache`},
+		{http.MethodDelete, `/admin/cache/docs`},
+		{http.MethodPost, `/admin/cache/docs/refresh`},
+		{http.MethodPost, `/admin/sign`},
+		{http.MethodGet, `/admin/audit`},
+		{http.MethodPost, `/publish/docs`},
+		{http.MethodPut, `/publish/docs/v2`},
+		{http.MethodPost, `/publish/docs/v2/activate`},
+	} {
+		// sec doesn't check headers that aren't a scheme and a token
+		for _, authorization := range []string{``, `Bearer`, `Bearer two parts`} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(test.method, test.url, nil)
+			if authorization != `` {
+				r.Header.Set(`Authorization`, authorization)
+			}
+			g.ServeHTTP(w, r)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf(`%v %v with Authorization %q: got %v, expected %v`, test.method, test.url, authorization, w.Code, http.StatusUnauthorized)
+			}
+		}
+	}
+}
+
+// makeTarGz makes a site archive of files, by name
+func makeTarGz(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, body := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(body))
+	}
+	tw.Close()
+	gz.Close()
+
+	return buf.Bytes()
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+// SnapshotSummary describes a cached snapshot for the admin API
+type SnapshotSummary struct {
+	Project    string    `json:"project"`
+	Release    string    `json:"release"`
+	Source     string    `json:"source"`
+	ETag       string    `json:"etag,omitempty"`
+	Access     string    `json:"access"`
+	Files      int       `json:"files"`
+	Bytes      int64     `json:"bytes"`
+	Loaded     time.Time `json:"loaded"`
+	AgeSeconds int       `json:"age-seconds"`
+	Fresh      bool      `json:"fresh"`
+	Hits       int       `json:"hits"`
+}
+
+// FileSummary describes one file in a cached snapshot for the admin API
+type FileSummary struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	OnDisk bool   `json:"on-disk"`
+}
+
+// Summary describes the snapshot for the admin API
+func (s *Snapshot) Summary() SnapshotSummary {
+	rtn := SnapshotSummary{
+		Project:    s.Project,
+		Release:    s.Release,
+		Source:     s.Source,
+		ETag:       s.ETag,
+		Access:     cfg.Config.AccessFor(s.Project, s.Manifest.Access),
+		Files:      len(s.files),
+		Loaded:     s.Loaded,
+		AgeSeconds: int(time.Since(s.Loaded).Seconds()),
+		Fresh:      s.fresh(),
+		Hits:       s.Hits.Clicks,
+	}
+	for _, f := range s.files {
+		rtn.Bytes += f.size
+	}
+
+	return rtn
+}
+
+// FileList lists the files in the snapshot, in path order
+func (s *Snapshot) FileList() []FileSummary {
+	rtn := make([]FileSummary, 0, len(s.files))
+	for docPath, f := range s.files {
+		rtn = append(rtn, FileSummary{Path: docPath, Size: f.size, OnDisk: f.path != ``})
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].Path < rtn[j].Path })
+
+	return rtn
+}
+
+// CachedSnapshots returns every snapshot in the memory cache, for project or for all projects if project is empty
+func CachedSnapshots(project string) []*Snapshot {
+	rtn := []*Snapshot{}
+	for _, item := range cache.Items() {
+		snap := item.Object.(*Snapshot)
+		if project == `` || snap.Project == project {
+			rtn = append(rtn, snap)
+		}
+	}
+	sort.Slice(rtn, func(i, j int) bool {
+		if rtn[i].Project != rtn[j].Project {
+			return rtn[i].Project < rtn[j].Project
+		}
+		return rtn[i].Release < rtn[j].Release
+	})
+
+	return rtn
+}
+
+// Purge drops every cached snapshot of project, or of all projects if project is empty, from memory and disk.
+// It returns the number of snapshots dropped from memory.
+func Purge(project string) int {
+	purged := 0
+	for key, item := range cache.Items() {
+		snap := item.Object.(*Snapshot)
+		if project == `` || snap.Project == project {
+			cache.Delete(key)
+			purged++
+		}
+	}
+
+	if project == `` {
+		activeReleases.Flush()
+	} else {
+		activeReleases.Delete(project)
+	}
+	disk.purge(project)
+	forgetMissing(project)
+
+	return purged
+}
+
+// Refresh loads project again from the container and, once every release we serve has loaded and passed validation,
+// drops what we had cached for it and serves the new snapshots instead. If any release fails, nothing changes.
+// Blob mode projects are only dropped, since their files are loaded as they are asked for.
+func (bs *BlobService) Refresh(c msrqc.Context, project string) (int, error) {
+	if cfg.Config.ForProject(project).Mode == cfg.ModeBlob {
+		Purge(project)
+		return http.StatusOK, nil
+	}
+
+	client, err := bs.initializeClient(c)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	// the active release may have changed too
+	activeReleases.Delete(project)
+	loaded := map[string]*Snapshot{}
+	discardAll := func() {
+		for _, snap := range loaded {
+			snap.discard()
+		}
+	}
+	for _, release := range bs.servedReleases(c, project) {
+		dr, blobName, err := bs.findArchive(c, client, project, release, ``, nil)
+		if err != nil {
+			discardAll()
+			_, status := ClassifyError(err)
+			return status, err
+		}
+		snap, report := extractDownload(c, project, release, blobName, dr)
+		if snap == nil {
+			discardAll()
+			if report.Limit != nil {
+				return http.StatusInternalServerError, report.Limit
+			}
+			return http.StatusInternalServerError, ErrArchiveInvalid
+		}
+		loaded[siteKey(project, release)] = snap
+	}
+
+	old := CachedSnapshots(project)
+	Purge(project)
+	for key, snap := range loaded {
+		cache.Set(key, snap, 0)
+		go disk.store(key, snap)
+	}
+	for _, snap := range old {
+		snap.retire()
+	}
+
+	return http.StatusOK, nil
+}
+
+// purge removes every snapshot of project, or of all projects if project is empty, from the disk cache
+func (dc *diskCache) purge(project string) {
+	if dc == nil {
+		return
+	}
+
+	dc.Lock()
+	defer dc.Unlock()
+	for folder := range dc.usage {
+		if project != `` {
+			m, err := readManifest(folder)
+			if err != nil || m.Project != project {
+				continue
+			}
+		}
+		dc.drop(folder)
+	}
+}
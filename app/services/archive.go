@@ -0,0 +1,295 @@
+package services
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/log"
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ArchiveProblem describes one reason an archive was rejected
+type ArchiveProblem struct {
+	Path   string `json:"path,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// ArchiveReport is the result of validating a site archive
+type ArchiveReport struct {
+	Valid    bool             `json:"valid"`
+	Files    int              `json:"files"`
+	Bytes    int64            `json:"bytes"`
+	Links    int              `json:"links"`
+	Problems []ArchiveProblem `json:"problems,omitempty"`
+	// Limit is set when extraction stopped because the archive went over one of the extraction limits
+	Limit *LimitError `json:"limit,omitempty"`
+}
+
+func (r *ArchiveReport) addProblem(name, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, ArchiveProblem{Path: name, Reason: fmt.Sprintf(format, args...)})
+}
+
+// ValidateArchive reads archive all the way through and reports everything wrong with it as a site for project
+func ValidateArchive(c msrqc.Context, project string, archive io.Reader) *ArchiveReport {
+	snap, report := extractArchive(c, project, archive)
+	snap.discard()
+	return report
+}
+
+// extractArchive unpacks a gzipped tarball or zip file into a snapshot of project, validating as it goes.
+// The snapshot must not be used unless the report is valid.
+// The archive is rejected if it can't be read, has no index.html for the project,
+// or has entries with absolute or parent paths, duplicate names or unsupported types.
+// Symlinks and hard links are resolved to copies of the files they point at, and must stay inside the site.
+// Entry names are normalized and, if the whole site is inside a single folder, taken relative to that folder;
+// the files are keyed under project whatever the archive calls its top folder.
+// Extraction stops as soon as the archive goes over one of the extraction limits.
+func extractArchive(c msrqc.Context, project string, archive io.Reader) (*Snapshot, *ArchiveReport) {
+	lw := log.ForFunc(c)
+	report := &ArchiveReport{}
+	snap := newSnapshot(project)
+	limits := newLimitTracker(archive)
+
+	entries, err := openArchive(limits.compressed, limits.limits.spillDir)
+	if err != nil {
+		if report.stopForLimit(c, project, err) {
+			return snap, report
+		}
+		lw.WithError(err).Error("error opening archive")
+		report.addProblem(``, `%v`, err)
+		return snap, report
+	}
+	defer entries.close()
+
+	files := map[string]*snapshotFile{}
+	links := []archiveLink{}
+	tops := map[string]bool{}
+	rootFiles := false
+	for {
+		entry, err := entries.next()
+		if err == io.EOF {
+			break // End of archive
+		}
+		if err != nil {
+			if report.stopForLimit(c, project, err) {
+				return snap, report
+			}
+			lw.WithError(err).Error("invalid archive entry")
+			report.addProblem(``, `invalid archive entry: %v`, err)
+			return snap, report
+		}
+
+		if report.stopForLimit(c, project, limits.addEntry()) {
+			return snap, report
+		}
+
+		name, problem := normalizeEntryName(entry.name)
+		if problem != `` {
+			report.addProblem(entry.name, problem)
+			continue
+		}
+		if name == `.` {
+			continue // the archive root itself
+		}
+		top, _, nested := strings.Cut(name, `/`)
+		tops[top] = true
+
+		switch entry.kind {
+		case entryDir:
+		case entryFile:
+			if _, dup := files[name]; dup {
+				report.addProblem(entry.name, `duplicate entry`)
+			}
+			f, errRead := readEntry(snap, entry, limits)
+			if report.stopForLimit(c, project, errRead) {
+				return snap, report
+			}
+			if errRead != nil {
+				lw.SetName(name).WithError(errRead).Error("error reading a file from archive")
+				report.addProblem(entry.name, `error reading file: %v`, errRead)
+				return snap, report
+			}
+			files[name] = f
+			rootFiles = rootFiles || !nested
+			report.Files++
+			report.Bytes += f.size
+		case entrySymlink, entryHardLink:
+			target, problem := linkTarget(name, entry)
+			if problem != `` {
+				report.addProblem(entry.name, problem)
+				continue
+			}
+			links = append(links, archiveLink{name: name, raw: entry.name, target: target})
+			rootFiles = rootFiles || !nested
+		default:
+			report.addProblem(entry.name, `unsupported entry type %q`, entry.typeName)
+		}
+	}
+
+	// an archive with everything inside one folder, whatever it is called, is served from inside that folder,
+	// unless the project says otherwise
+	wrapper := ``
+	if len(tops) == 1 && !rootFiles && cfg.Config.ForProject(project).StripsWrapper() {
+		for top := range tops {
+			wrapper = top + `/`
+		}
+	}
+
+	inside := links[:0]
+	linkNames := map[string]bool{}
+	for _, l := range links {
+		if _, dup := files[l.name]; dup || linkNames[l.name] {
+			report.addProblem(l.raw, `duplicate entry`)
+		} else if !strings.HasPrefix(l.target+`/`, wrapper) {
+			report.addProblem(l.raw, `link escapes the site root`)
+		} else {
+			inside = append(inside, l)
+		}
+		linkNames[l.name] = true
+	}
+	resolved, unresolved, err := resolveLinks(files, inside, limits)
+	if report.stopForLimit(c, project, err) {
+		return snap, report
+	}
+	report.Links = resolved
+	for _, l := range unresolved {
+		report.addProblem(l.raw, `link target %v is not in the archive, or is a loop of links`, l.target)
+	}
+
+	for name, f := range files {
+		snap.files[project+`/`+strings.TrimPrefix(name, wrapper)] = f
+	}
+
+	snap.readSiteManifest(report)
+	if _, ok := snap.files[project+`/index.html`]; !ok {
+		report.addProblem(wrapper+`index.html`, `archive has no index.html at its root`)
+	}
+
+	report.Valid = len(report.Problems) == 0
+	return snap, report
+}
+
+// normalizeEntryName cleans an archive entry name into a slash-separated path relative to the archive root,
+// so that ./index.html, index.html and .\index.html all mean the same thing.
+// It returns a problem instead if the name is absolute, with a Windows drive or not, or leaves the archive.
+func normalizeEntryName(raw string) (string, string) {
+	name := strings.ReplaceAll(raw, `\`, `/`)
+	if strings.HasPrefix(name, `/`) || path.IsAbs(name) || hasDrivePrefix(name) {
+		return ``, `absolute path`
+	}
+	if hasParentElement(name) {
+		return ``, `path leaves the archive`
+	}
+
+	return path.Clean(name), ``
+}
+
+// hasDrivePrefix reports whether name starts with a Windows drive, as C: or C:/ do; a:b.txt is just a name
+func hasDrivePrefix(name string) bool {
+	if len(name) < 2 || name[1] != ':' {
+		return false
+	}
+	letter := name[0] | 0x20
+
+	return letter >= 'a' && letter <= 'z' && (len(name) == 2 || name[2] == '/')
+}
+
+// openArchive works out what kind of archive r holds and returns an iterator over its entries.
+// Tarballs, gzipped or zstd compressed, are read as they stream in; zip files are copied to a temporary file in spillDir first.
+func openArchive(r io.Reader, spillDir string) (entryIterator, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+
+	switch DetectFormat(``, head) {
+	case FormatTarGz:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf(`archive is not gzipped: %w`, err)
+		}
+		return &tarEntries{tr: tar.NewReader(gz)}, nil
+	case FormatZip:
+		// zip keeps its directory at the end, so we need the whole thing before we can read any of it
+		return spoolZip(br, spillDir)
+	case FormatTarZst:
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindow))
+		if err != nil {
+			return nil, fmt.Errorf(`archive is not zstd compressed: %w`, err)
+		}
+		return &tarEntries{tr: tar.NewReader(zr), closer: zr.Close}, nil
+	}
+
+	return nil, errors.New(`archive is not a gzipped or zstd compressed tarball, or a zip file`)
+}
+
+// spoolZip copies a zip file to a temporary file so that we can read it from the end
+func spoolZip(r io.Reader, spillDir string) (entryIterator, error) {
+	spool, err := os.CreateTemp(spillDir, `ms-sites-zip-`)
+	if err != nil {
+		return nil, err
+	}
+	ze := &zipEntries{spool: spool}
+
+	size, err := io.Copy(spool, r)
+	if err != nil {
+		ze.close()
+		return nil, err
+	}
+	zr, err := zip.NewReader(spool, size)
+	if err != nil {
+		ze.close()
+		return nil, fmt.Errorf(`archive is not a valid zip file: %w`, err)
+	}
+	ze.files = zr.File
+
+	return ze, nil
+}
+
+// readEntry reads the contents of a file entry into snap, within the extraction limits
+func readEntry(snap *Snapshot, entry *archiveEntry, limits *limitTracker) (*snapshotFile, error) {
+	rc, err := entry.open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return snap.readFile(rc, limits)
+}
+
+// stopForLimit records err on the report if it is a limit breach, and reports whether it was
+func (r *ArchiveReport) stopForLimit(c msrqc.Context, project string, err error) bool {
+	var le *LimitError
+	if !errors.As(err, &le) {
+		return false
+	}
+
+	r.Limit = le
+	r.addProblem(``, le.Error())
+	r.Valid = false
+	recordLimitBreach(c, project, le)
+
+	return true
+}
+
+// hasParentElement reports whether any element of the slash-separated name is ".."
+func hasParentElement(name string) bool {
+	for _, element := range strings.Split(name, `/`) {
+		if element == `..` {
+			return true
+		}
+	}
+
+	return false
+}
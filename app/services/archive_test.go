@@ -0,0 +1,448 @@
+package services
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+	"github.com/elephant-insurance/go-microservice-arch/v2/sec"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+	"github.com/klauspost/compress/zstd"
+)
+
+type testEntry struct {
+	name     string
+	typeflag byte
+	body     string
+}
+
+func makeTarGz(t testing.TB, entries []testEntry) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	writeTar(t, gz, entries)
+	gz.Close()
+
+	return buf.Bytes()
+}
+
+func makeTarZst(t testing.TB, entries []testEntry) []byte {
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTar(t, zw, entries)
+	zw.Close()
+
+	return buf.Bytes()
+}
+
+func writeTar(t testing.TB, w io.Writer, entries []testEntry) {
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0644, Size: int64(len(e.body))}
+		if e.typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if e.typeflag == tar.TypeSymlink || e.typeflag == tar.TypeLink {
+			// the body of a test link is its target
+			hdr.Linkname = e.body
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if e.typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	tw.Close()
+}
+
+func makeZip(t testing.TB, entries []testEntry) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	zw.Close()
+
+	return buf.Bytes()
+}
+
+var archiveTests = []struct {
+	label   string
+	entries []testEntry
+	valid   bool
+}{
+	{`good site`, []testEntry{{`docs/`, tar.TypeDir, ``}, {`docs/index.html`, tar.TypeReg, `<html/>`}, {`docs/site.css`, tar.TypeReg, `body{}`}}, true},
+	{`no index`, []testEntry{{`docs/site.css`, tar.TypeReg, `body{}`}}, false},
+	{`absolute path`, []testEntry{{`docs/index.html`, tar.TypeReg, `x`}, {`/etc/passwd`, tar.TypeReg, `x`}}, false},
+	{`parent path`, []testEntry{{`docs/index.html`, tar.TypeReg, `x`}, {`docs/../../x`, tar.TypeReg, `x`}}, false},
+	{`duplicate`, []testEntry{{`docs/index.html`, tar.TypeReg, `x`}, {`docs/index.html`, tar.TypeReg, `y`}}, false},
+	{`dot slash`, []testEntry{{`./`, tar.TypeDir, ``}, {`./index.html`, tar.TypeReg, `x`}, {`./css/site.css`, tar.TypeReg, `x`}}, true},
+	{`wrapper folder`, []testEntry{{`dist/`, tar.TypeDir, ``}, {`dist/index.html`, tar.TypeReg, `x`}}, true},
+	{`backslashes`, []testEntry{{`index.html`, tar.TypeReg, `x`}, {`css\site.css`, tar.TypeReg, `x`}}, true},
+	{`drive letter`, []testEntry{{`index.html`, tar.TypeReg, `x`}, {`C:\Windows\win.ini`, tar.TypeReg, `x`}}, false},
+	{`bare drive`, []testEntry{{`index.html`, tar.TypeReg, `x`}, {`d:`, tar.TypeReg, `x`}}, false},
+	{`colon in name`, []testEntry{{`index.html`, tar.TypeReg, `x`}, {`a:b.txt`, tar.TypeReg, `x`}, {`1:2/x.txt`, tar.TypeReg, `x`}}, true},
+	{`two folders`, []testEntry{{`dist/index.html`, tar.TypeReg, `x`}, {`other/index.html`, tar.TypeReg, `x`}}, false},
+	{`normalized duplicate`, []testEntry{{`index.html`, tar.TypeReg, `x`}, {`./index.html`, tar.TypeReg, `y`}}, false},
+	{`symlink`, []testEntry{{`index.html`, tar.TypeReg, `x`}, {`home.html`, tar.TypeSymlink, `index.html`}}, true},
+	{`escaping symlink`, []testEntry{{`index.html`, tar.TypeReg, `x`}, {`passwd`, tar.TypeSymlink, `../../etc/passwd`}}, false},
+	{`absolute symlink`, []testEntry{{`index.html`, tar.TypeReg, `x`}, {`passwd`, tar.TypeSymlink, `/etc/passwd`}}, false},
+	{`dangling symlink`, []testEntry{{`index.html`, tar.TypeReg, `x`}, {`latest`, tar.TypeSymlink, `v4`}}, false},
+	{`symlink loop`, []testEntry{{`index.html`, tar.TypeReg, `x`}, {`a`, tar.TypeSymlink, `b`}, {`b`, tar.TypeSymlink, `a`}}, false},
+	{`symlink out of wrapper`, []testEntry{{`dist/index.html`, tar.TypeReg, `x`}, {`dist/up`, tar.TypeSymlink, `..`}}, false},
+	{`fifo`, []testEntry{{`docs/index.html`, tar.TypeReg, `x`}, {`docs/pipe`, tar.TypeFifo, ``}}, false},
+}
+
+func TestValidateArchive(t *testing.T) {
+	c := msrqc.New(context.Background())
+	for _, test := range archiveTests {
+		report := ValidateArchive(c, `docs`, bytes.NewReader(makeTarGz(t, test.entries)))
+		if report.Valid != test.valid {
+			t.Errorf(`%v: expected valid = %v, got problems %v`, test.label, test.valid, report.Problems)
+		}
+	}
+}
+
+func TestExtractArchiveKeepWrapper(t *testing.T) {
+	c := msrqc.New(context.Background())
+	keep := false
+	defer func() { cfg.Config = nil }()
+	cfg.Config = &cfg.AppConfig{Projects: map[string]cfg.ProjectSettings{`docs`: {StripWrapper: &keep}}}
+	entries := []testEntry{{`site/index.html`, tar.TypeReg, `x`}, {`site/css/site.css`, tar.TypeReg, `body{}`}}
+
+	snap, report := extractArchive(c, `docs`, bytes.NewReader(makeTarGz(t, entries)))
+	if report.Valid {
+		t.Error(`archive with no index.html at its root accepted though its wrapper isn't stripped`)
+	}
+	if _, _, err := snap.Open(`docs/site/css/site.css`); err != nil {
+		t.Error(`files should keep their wrapper folder`)
+	}
+	if report := ValidateArchive(c, `other`, bytes.NewReader(makeTarGz(t, entries))); !report.Valid {
+		t.Errorf(`other projects should still strip the wrapper, got problems %v`, report.Problems)
+	}
+}
+
+func TestExtractArchiveKeys(t *testing.T) {
+	c := msrqc.New(context.Background())
+	snap, report := extractArchive(c, `docs`, bytes.NewReader(makeTarGz(t, []testEntry{
+		{`./site-v3/`, tar.TypeDir, ``},
+		{`./site-v3/index.html`, tar.TypeReg, `<html/>`},
+		{`site-v3\css\site.css`, tar.TypeReg, `body{}`},
+	})))
+	if !report.Valid {
+		t.Fatalf(`archive rejected: %v`, report.Problems)
+	}
+	for _, key := range []string{`docs/index.html`, `docs/css/site.css`} {
+		if _, _, err := snap.Open(key); err != nil {
+			t.Errorf(`%v not found in snapshot`, key)
+		}
+	}
+}
+
+func TestExtractArchiveLinks(t *testing.T) {
+	c := msrqc.New(context.Background())
+	snap, report := extractArchive(c, `docs`, bytes.NewReader(makeTarGz(t, []testEntry{
+		{`site/v3/index.html`, tar.TypeReg, `v3`},
+		{`site/v3/css/site.css`, tar.TypeReg, `body{}`},
+		{`site/latest`, tar.TypeSymlink, `v3`},
+		{`site/current`, tar.TypeSymlink, `latest`},
+		{`site/index.html`, tar.TypeLink, `site/v3/index.html`},
+	})))
+	if !report.Valid {
+		t.Fatalf(`archive rejected: %v`, report.Problems)
+	}
+	if report.Links != 3 {
+		t.Errorf(`expected 3 links resolved, got %v`, report.Links)
+	}
+	for _, key := range []string{`docs/index.html`, `docs/latest/index.html`, `docs/latest/css/site.css`, `docs/current/css/site.css`} {
+		if _, _, err := snap.Open(key); err != nil {
+			t.Errorf(`%v not found in snapshot`, key)
+		}
+	}
+}
+
+func TestValidateArchiveZip(t *testing.T) {
+	c := msrqc.New(context.Background())
+	for _, test := range archiveTests {
+		if hasLinks(test.entries) {
+			continue // makeZip only writes files and folders
+		}
+		report := ValidateArchive(c, `docs`, bytes.NewReader(makeZip(t, test.entries)))
+		if report.Valid != test.valid {
+			t.Errorf(`%v (zip): expected valid = %v, got problems %v`, test.label, test.valid, report.Problems)
+		}
+	}
+
+}
+
+func TestValidateArchiveTarZst(t *testing.T) {
+	c := msrqc.New(context.Background())
+	for _, test := range archiveTests {
+		report := ValidateArchive(c, `docs`, bytes.NewReader(makeTarZst(t, test.entries)))
+		if report.Valid != test.valid {
+			t.Errorf(`%v (tar.zst): expected valid = %v, got problems %v`, test.label, test.valid, report.Problems)
+		}
+	}
+
+	snap, report := extractArchive(c, `docs`, bytes.NewReader(makeTarZst(t, archiveTests[0].entries)))
+	if !report.Valid {
+		t.Fatalf(`archive rejected: %v`, report.Problems)
+	}
+	doc, _, err := snap.Open(`docs/site.css`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(doc)
+	doc.Close()
+	if string(data) != `body{}` {
+		t.Errorf(`file from tar.zst doesn't match: %q`, data)
+	}
+
+	corrupt := append([]byte{0x28, 0xb5, 0x2f, 0xfd}, make([]byte, 32)...)
+	if report := ValidateArchive(c, `docs`, bytes.NewReader(corrupt)); report.Valid {
+		t.Error(`corrupt tar.zst accepted`)
+	}
+}
+
+func hasLinks(entries []testEntry) bool {
+	for _, e := range entries {
+		if e.typeflag != tar.TypeReg && e.typeflag != tar.TypeDir {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		head   []byte
+		format ArchiveFormat
+	}{
+		{`docs.zip`, []byte{0x1f, 0x8b, 8}, FormatTarGz},
+		{`docs.tar.gz`, []byte("PK\x03\x04"), FormatZip},
+		{`docs.TGZ`, nil, FormatTarGz},
+		{`docs.tar.zst`, nil, FormatTarZst},
+		{`docs.rar`, []byte(`Rar!`), FormatUnknown},
+	}
+	for _, test := range tests {
+		if got := DetectFormat(test.name, test.head); got != test.format {
+			t.Errorf(`%v: expected %q, got %q`, test.name, test.format, got)
+		}
+	}
+}
+
+func TestValidateArchiveCorrupt(t *testing.T) {
+	c := msrqc.New(context.Background())
+	good := makeTarGz(t, archiveTests[0].entries)
+
+	if report := ValidateArchive(c, `docs`, bytes.NewReader([]byte(`not an archive`))); report.Valid {
+		t.Error(`garbage accepted as an archive`)
+	}
+	if report := ValidateArchive(c, `docs`, bytes.NewReader(good[:len(good)/2])); report.Valid {
+		t.Error(`truncated archive accepted`)
+	}
+}
+
+func TestValidateArchiveLimits(t *testing.T) {
+	c := msrqc.New(context.Background())
+	entries := archiveTests[0].entries
+	one, big := 1, 1<<30
+	bomb := []testEntry{{`docs/index.html`, tar.TypeReg, string(make([]byte, 4<<20))}}
+
+	limitTests := []struct {
+		label    string
+		settings cfg.ExtractionSettings
+		entries  []testEntry
+		limit    string
+	}{
+		{`entries`, cfg.ExtractionSettings{MaxEntries: &one}, entries, LimitEntries},
+		{`file size`, cfg.ExtractionSettings{MaxFileBytes: &one}, entries, LimitFileBytes},
+		{`total size`, cfg.ExtractionSettings{MaxUncompressedBytes: &one}, entries, LimitUncompressedBytes},
+		{`compressed size`, cfg.ExtractionSettings{MaxCompressedBytes: &one}, entries, LimitCompressedBytes},
+		{`ratio`, cfg.ExtractionSettings{MaxUncompressedBytes: &big}, bomb, LimitCompressionRatio},
+	}
+
+	// alerts raised by other tests aren't ours to count
+	LimitAlerts()
+	defer func() { cfg.Config = nil }()
+	for _, test := range limitTests {
+		cfg.Config = &cfg.AppConfig{Extraction: test.settings}
+		before := LimitBreaches.Clicks
+		report := ValidateArchive(c, `docs`, bytes.NewReader(makeTarGz(t, test.entries)))
+		if report.Valid || report.Limit == nil || report.Limit.Limit != test.limit {
+			t.Errorf(`%v: expected the %v limit, got %+v`, test.label, test.limit, report.Limit)
+		}
+		if LimitBreaches.Clicks != before+1 {
+			t.Errorf(`%v: breach not counted`, test.label)
+		}
+	}
+	if len(LimitAlerts()) != len(limitTests) {
+		t.Error(`limit breaches not raised as alerts`)
+	}
+}
+
+func TestCountingReader(t *testing.T) {
+	buf := make([]byte, 16)
+	for _, cr := range []*countingReader{
+		{r: bytes.NewReader(make([]byte, 64)), max: 3},
+		// well past the limit already
+		{r: bytes.NewReader(make([]byte, 64)), max: 3, count: 10},
+	} {
+		for i := 0; i < 3; i++ {
+			// reads after the limit has been passed keep failing, rather than panicking
+			n, err := cr.Read(buf)
+			var le *LimitError
+			if n != 0 || !errors.As(err, &le) {
+				t.Errorf(`read %v from %v: expected the limit error, got %v bytes and %v`, i, cr.count, n, err)
+			}
+		}
+	}
+}
+
+func TestExtractArchiveSpills(t *testing.T) {
+	c := msrqc.New(context.Background())
+	spill := 4
+	defer func() { cfg.Config = nil }()
+	cfg.Config = &cfg.AppConfig{Extraction: cfg.ExtractionSettings{SpillBytes: &spill, SpillDir: t.TempDir()}}
+
+	entries := []testEntry{{`index.html`, tar.TypeReg, `<html>big enough to spill</html>`}, {`a.css`, tar.TypeReg, `a{}`}}
+	snap, report := extractArchive(c, `docs`, bytes.NewReader(makeTarGz(t, entries)))
+	if !report.Valid {
+		t.Fatalf(`archive rejected: %v`, report.Problems)
+	}
+	if snap.files[`docs/index.html`].path == `` || snap.files[`docs/a.css`].path != `` {
+		t.Error(`expected only the big file to be spilled`)
+	}
+
+	doc, size, err := snap.Open(`docs/index.html`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(doc)
+	doc.Close()
+	if string(data) != entries[0].body || size != int64(len(data)) {
+		t.Errorf(`spilled file came back as %q`, data)
+	}
+
+	inMemory := &Snapshot{files: map[string]*snapshotFile{`x`: {data: data, size: size}}}
+	if snap.FileETag(`docs/index.html`) != inMemory.FileETag(`x`) {
+		t.Error(`spilled and in-memory ETags differ for the same content`)
+	}
+
+	snap.discard()
+	if _, _, err := snap.Open(`docs/index.html`); err == nil {
+		t.Error(`spilled file still there after discard`)
+	}
+}
+
+func TestExtractArchiveManifest(t *testing.T) {
+	c := msrqc.New(context.Background())
+	defer func() { cfg.Config = nil }()
+	cfg.Config = &cfg.AppConfig{
+		Projects: map[string]cfg.ProjectSettings{`overridden`: {Access: cfg.AccessKey}},
+		Security: sec.Settings{OktaBaseAddress: `https://example.okta.com`, OktaClientID: `client`},
+	}
+
+	entries := []testEntry{
+		{`site/index.html`, tar.TypeReg, `<html/>`},
+		{`site/` + SiteManifestName, tar.TypeReg, `{"access":"okta"}`},
+	}
+	snap, report := extractArchive(c, `docs`, bytes.NewReader(makeTarGz(t, entries)))
+	defer snap.discard()
+	if !report.Valid {
+		t.Fatalf(`archive rejected: %v`, report.Problems)
+	}
+	if _, _, err := snap.Open(`docs/` + SiteManifestName); err == nil {
+		t.Error(`the site manifest should never be served`)
+	}
+	if access := cfg.Config.AccessFor(`docs`, snap.Manifest.Access); access != cfg.AccessOkta {
+		t.Errorf(`expected the manifest's access policy, got %v`, access)
+	}
+	if access := cfg.Config.AccessFor(`overridden`, snap.Manifest.Access); access != cfg.AccessKey {
+		t.Errorf(`project settings should override the manifest, got %v`, access)
+	}
+
+	entries[1].body = `{"access":"everybody"}`
+	if report := ValidateArchive(c, `docs`, bytes.NewReader(makeTarGz(t, entries))); report.Valid {
+		t.Error(`an unknown access policy should be rejected`)
+	}
+	for _, access := range []string{cfg.AccessLogin, cfg.AccessMsLogin} {
+		entries[1].body = `{"access":"` + access + `"}`
+		if report := ValidateArchive(c, `docs`, bytes.NewReader(makeTarGz(t, entries))); report.Valid {
+			t.Errorf(`%v access should be rejected without the settings it needs`, access)
+		}
+	}
+	cfg.Config.Security = sec.Settings{}
+	entries[1].body = `{"access":"okta"}`
+	if report := ValidateArchive(c, `docs`, bytes.NewReader(makeTarGz(t, entries))); report.Valid {
+		t.Error(`okta access should be rejected outside Okta mode`)
+	}
+}
+
+func TestExtractArchiveCORS(t *testing.T) {
+	c := msrqc.New(context.Background())
+	defer func() { cfg.Config = nil }()
+	maxAge := 600
+	cfg.Config = &cfg.AppConfig{Projects: map[string]cfg.ProjectSettings{
+		`overridden`: {CORS: &cfg.CORSSettings{Origins: `https://app.example.com, https://*.example.net`, MaxAgeSeconds: &maxAge}},
+		`closed`:     {CORS: &cfg.CORSSettings{Origins: cfg.CORSOff}},
+	}}
+
+	entries := []testEntry{
+		{`site/index.html`, tar.TypeReg, `<html/>`},
+		{`site/` + SiteManifestName, tar.TypeReg, `{"cors":{"origins":["https://quotes.example.com"],"methods":["GET"],"maxAgeSeconds":60}}`},
+	}
+	snap, report := extractArchive(c, `docs`, bytes.NewReader(makeTarGz(t, entries)))
+	defer snap.discard()
+	if !report.Valid {
+		t.Fatalf(`archive rejected: %v`, report.Problems)
+	}
+	if policy := cfg.Config.CORSFor(`docs`, snap.Manifest.CORS); policy == nil || len(policy.Origins) != 1 || *policy.MaxAgeSeconds != 60 {
+		t.Errorf(`expected the manifest's CORS policy, got %+v`, policy)
+	}
+	policy := cfg.Config.CORSFor(`overridden`, snap.Manifest.CORS)
+	if policy == nil || len(policy.Origins) != 2 || policy.Origins[1] != `https://*.example.net` || *policy.MaxAgeSeconds != 600 {
+		t.Fatalf(`project settings should override the manifest's, got %+v`, policy)
+	}
+	if len(policy.Methods) != 1 || policy.Methods[0] != `GET` {
+		t.Errorf(`settings config leaves alone should come from the manifest, got %v`, policy.Methods)
+	}
+	if policy := cfg.Config.CORSFor(`closed`, nil); policy == nil || cfg.CheckCORSPolicy(policy) != nil {
+		t.Errorf(`a project may let no other origin in, got %+v`, policy)
+	}
+	if policy := cfg.Config.CORSFor(`plain`, nil); policy != nil {
+		t.Errorf(`a project without a policy should get the global one, got %+v`, policy)
+	}
+
+	for _, bad := range []string{
+		`{"cors":{"origins":["app.example.com"]}}`,
+		`{"cors":{"origins":["https://*.*.example.com"]}}`,
+		`{"cors":{"origins":["off","https://app.example.com"]}}`,
+		`{"cors":{"methods":["TRACE"]}}`,
+		`{"cors":{"maxAgeSeconds":-1}}`,
+	} {
+		entries[1].body = bad
+		if report := ValidateArchive(c, `docs`, bytes.NewReader(makeTarGz(t, entries))); report.Valid {
+			t.Errorf(`CORS policy %v should be rejected`, bad)
+		}
+	}
+}
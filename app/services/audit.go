@@ -0,0 +1,155 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	enum "github.com/elephant-insurance/enumerations/v2"
+	"github.com/elephant-insurance/go-microservice-arch/v2/log"
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+	"github.com/elephant-insurance/go-microservice-arch/v2/rbuf"
+	"github.com/elephant-insurance/go-microservice-arch/v2/sec"
+	"github.com/elephant-insurance/go-microservice-arch/v2/uf"
+)
+
+// audited actions
+const (
+	AuditPublish  = `publish`
+	AuditActivate = `activate`
+	AuditPurge    = `purge`
+	AuditRefresh  = `refresh`
+	AuditSign     = `sign`
+)
+
+// audit outcomes
+const (
+	AuditSucceeded = `succeeded`
+	AuditRejected  = `rejected`
+	AuditFailed    = `failed`
+)
+
+const (
+	// we keep this many of the latest audit events for the admin endpoint; the log has them all
+	auditLogCapacity = 1000
+	// the actor of an action taken without a token, as when access is bypassed in development
+	unknownActor = `unknown`
+	// the actor of an action taken with one of the access keys sec shares between every caller in key mode
+	sharedKeyActor = `shared access key`
+	// secUserClaims is where sec keeps the claims of an Okta token it has verified
+	secUserClaims = `UserClaims`
+)
+
+// SharedKeyContextKey marks a request that got in with a shared access key, which sec lets through without leaving a token
+const SharedKeyContextKey = `sharedAccessKey`
+
+var auditLog rbuf.RingBuffer
+
+func init() {
+	var err error
+	if auditLog, err = rbuf.NewConcurrentRingBuffer(auditLogCapacity, nil); err != nil {
+		panic(err)
+	}
+}
+
+// AuditEvent records who changed what is live, and how it went
+type AuditEvent struct {
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`
+	Action  string    `json:"action"`
+	Project string    `json:"project,omitempty"`
+	Release string    `json:"release,omitempty"`
+	Outcome string    `json:"outcome"`
+	Status  int       `json:"status"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// Audit records that the caller took action on project, and release if there was one, and got status back.
+// The event is logged, so that it is kept, and added to the recent events for AuditEvents.
+func Audit(c msrqc.Context, action, project, release string, status int, detail string) *AuditEvent {
+	ae := &AuditEvent{
+		Time:    time.Now().UTC(),
+		Actor:   auditActor(c),
+		Action:  action,
+		Project: project,
+		Release: release,
+		Outcome: auditOutcome(status),
+		Status:  status,
+		Detail:  detail,
+	}
+	auditLog.Add(ae)
+
+	target := `every project`
+	if project != `` {
+		target = `project ` + project
+	}
+	if release != `` {
+		target += ` release ` + release
+	}
+	msg := fmt.Sprintf(`audit: %v of %v by %v %v`, action, target, ae.Actor, ae.Outcome)
+	eventID := &enum.Event.ServiceRequestFullSuccess.ID
+	switch ae.Outcome {
+	case AuditRejected:
+		eventID = &enum.Event.ServiceRequestInvalid.ID
+	case AuditFailed:
+		eventID = &enum.Event.ServiceRequestFailure.ID
+	}
+	evt := uf.EventFactory.New(eventID, nil, msg)
+	log.ForFunc(c).SetName(project).SetID(ae.Actor).SetCode(action).SetDetail(detail).
+		WithConsoleField("release", release).WithHTTPStatus(status).WithEvent(evt).Info(msg)
+
+	return ae
+}
+
+// AuditEvents returns up to count of the latest audit events, latest first, for project or for every project if it is empty
+func AuditEvents(project string, count int) []*AuditEvent {
+	rtn := []*AuditEvent{}
+	for _, item := range auditLog.Latest(0) {
+		ae, ok := item.(*AuditEvent)
+		if !ok || (project != `` && ae.Project != project) {
+			continue
+		}
+		if count > 0 && len(rtn) >= count {
+			break
+		}
+		rtn = append(rtn, ae)
+	}
+
+	return rtn
+}
+
+// auditActor names the caller as best it can: from their token, else the claims of their Okta token, else the shared key they used
+func auditActor(c msrqc.Context) string {
+	key := sec.ContextKeyAccessToken
+	if t, exists := msrqc.NamespaceGet(c, &msrqc.NamespaceKeySec, &key); exists {
+		if token, ok := t.(sec.AccessToken); ok {
+			for _, name := range []string{token.UserName, token.Email, token.Subject, token.UserID} {
+				if name != `` {
+					return name
+				}
+			}
+		}
+	}
+	if claims, exists := c.Get(secUserClaims); exists {
+		if verified, ok := claims.(sec.OktaClaims); ok && verified.Subject != `` {
+			return verified.Subject
+		}
+	}
+	if shared, _ := c.Get(SharedKeyContextKey); shared == true {
+		return sharedKeyActor
+	}
+
+	return unknownActor
+}
+
+// auditOutcome says whether status means the action happened, was refused, or went wrong
+func auditOutcome(status int) string {
+	switch {
+	case status < http.StatusBadRequest:
+		return AuditSucceeded
+	case status < http.StatusInternalServerError:
+		return AuditRejected
+	default:
+		return AuditFailed
+	}
+}
@@ -0,0 +1,50 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+	"github.com/elephant-insurance/go-microservice-arch/v2/sec"
+)
+
+func TestAudit(t *testing.T) {
+	c := msrqc.New(context.Background())
+	key := sec.ContextKeyAccessToken
+	msrqc.NamespaceSet(c, &msrqc.NamespaceKeySec, &key, sec.AccessToken{Subject: `0oa1`, Email: `pat@example.com`}, true)
+
+	Audit(c, AuditPublish, `audit-docs`, `v1`, http.StatusCreated, ``)
+	Audit(c, AuditActivate, `audit-docs`, `v1`, http.StatusNotFound, `no such release`)
+	Audit(c, AuditPurge, `audit-widgets`, ``, http.StatusOK, ``)
+	Audit(msrqc.New(context.Background()), AuditRefresh, `audit-docs`, ``, http.StatusBadGateway, `container unavailable`)
+
+	events := AuditEvents(`audit-docs`, 0)
+	if len(events) != 3 {
+		t.Fatalf(`expected 3 events for the project, got %v`, len(events))
+	}
+	if events[0].Action != AuditRefresh || events[0].Outcome != AuditFailed || events[0].Actor != unknownActor {
+		t.Errorf(`latest event should be the failed refresh by nobody we know: %+v`, events[0])
+	}
+	if events[1].Outcome != AuditRejected || events[1].Detail != `no such release` {
+		t.Errorf(`activation should be rejected: %+v`, events[1])
+	}
+	if events[2].Actor != `pat@example.com` || events[2].Outcome != AuditSucceeded || events[2].Release != `v1` {
+		t.Errorf(`publish should be by its actor and succeed: %+v`, events[2])
+	}
+
+	if events := AuditEvents(``, 2); len(events) != 2 || events[0].Project != `audit-docs` || events[1].Project != `audit-widgets` {
+		t.Errorf(`expected the latest 2 events of every project: %+v`, events)
+	}
+
+	okta := msrqc.New(context.Background())
+	okta.Set(secUserClaims, sec.OktaClaims{Subject: `00u1`})
+	shared := msrqc.New(context.Background())
+	shared.Set(SharedKeyContextKey, true)
+	if ae := Audit(okta, AuditRefresh, `audit-actors`, ``, http.StatusOK, ``); ae.Actor != `00u1` {
+		t.Errorf(`an Okta caller should be known by their subject, got %q`, ae.Actor)
+	}
+	if ae := Audit(shared, AuditRefresh, `audit-actors`, ``, http.StatusOK, ``); ae.Actor != sharedKeyActor {
+		t.Errorf(`a caller with a shared access key should be recorded as using it, got %q`, ae.Actor)
+	}
+}
@@ -0,0 +1,40 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	goCache "github.com/patrickmn/go-cache"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicAuthSeconds is how long we remember a good password, so that every file of a page doesn't cost a bcrypt comparison
+const basicAuthSeconds = 5 * 60
+
+var (
+	basicAuthVerified = goCache.New(basicAuthSeconds*time.Second, 2*basicAuthSeconds*time.Second)
+	// basicAuthDecoy is compared against when the user is unknown, so that unknown users take as long as wrong passwords
+	basicAuthDecoy, _ = bcrypt.GenerateFromPassword([]byte(`decoy`), bcrypt.DefaultCost)
+)
+
+// CheckBasicAuth reports whether password is the password of user among users, user to bcrypt hash
+func CheckBasicAuth(users map[string]string, user, password string) bool {
+	hash, found := users[user]
+	if !found {
+		bcrypt.CompareHashAndPassword(basicAuthDecoy, []byte(password))
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + hash))
+	key := hex.EncodeToString(sum[:])
+	if _, verified := basicAuthVerified.Get(key); verified {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	basicAuthVerified.SetDefault(key, true)
+
+	return true
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckBasicAuth(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte(`s3cret`), bcrypt.MinCost)
+	defer func() { cfg.Config = nil }()
+	cfg.Config = &cfg.AppConfig{Projects: map[string]cfg.ProjectSettings{
+		`staging`: {Access: cfg.AccessBasic, BasicAuth: `qa:` + string(hash)},
+	}}
+	if !cfg.Config.AccessConfigured(`staging`) {
+		t.Error(`basic access with users in config should be settled by config`)
+	}
+
+	users := cfg.Config.BasicAuthFor(`staging`, map[string]string{`other`: string(hash)})
+	if _, found := users[`other`]; found || cfg.CheckBasicAuthUser(`qa`, users[`qa`]) != nil {
+		t.Fatalf(`config users should replace the manifest's, got %v`, users)
+	}
+	for i := 0; i < 2; i++ {
+		if !CheckBasicAuth(users, `qa`, `s3cret`) {
+			t.Errorf(`good password rejected, try %v`, i)
+		}
+	}
+	if CheckBasicAuth(users, `qa`, `wrong`) || CheckBasicAuth(users, `nobody`, `s3cret`) {
+		t.Error(`bad credentials accepted`)
+	}
+	if cfg.CheckBasicAuthUser(`qa`, `s3cret`) == nil {
+		t.Error(`plain text password accepted as a hash`)
+	}
+}
+
+func TestAllowedIPs(t *testing.T) {
+	defer func() { cfg.Config = nil }()
+	cfg.Config = &cfg.AppConfig{Projects: map[string]cfg.ProjectSettings{
+		`staging`: {AllowedIPs: `10.0.0.0/8, 192.168.1.7,2001:db8::/32`},
+		`broken`:  {AllowedIPs: `not-an-address`},
+	}}
+
+	if cfg.Config.AllowedIPsFor(`docs`, nil) != nil {
+		t.Error(`a project without allowed IPs should let any address in`)
+	}
+	if ranges := cfg.Config.AllowedIPsFor(`broken`, nil); ranges == nil || len(ranges) != 0 {
+		t.Error(`a project with only bad allowed IPs should let nobody in`)
+	}
+	ranges := cfg.Config.AllowedIPsFor(`staging`, []string{`172.16.0.0/12`})
+	if len(ranges) != 3 {
+		t.Fatalf(`config ranges should replace the manifest's, got %v`, ranges)
+	}
+
+	hops := 1
+	cfg.Config.Proxies.Hops = &hops
+	tests := []struct {
+		remote, forwarded, expected string
+	}{
+		{`10.1.2.3:5555`, ``, `10.1.2.3`},
+		{`10.9.9.9:5555`, `192.168.1.7`, `192.168.1.7`},
+		// whatever the client put in front of what our proxy added is ignored
+		{`10.9.9.9:5555`, `10.0.0.1, 203.0.113.5`, `203.0.113.5`},
+		// Azure front ends add the port
+		{`10.9.9.9:5555`, `203.0.113.5:5678`, `203.0.113.5`},
+		{`10.9.9.9:5555`, `[2001:db8::1]:5678`, `2001:db8::1`},
+		{`10.9.9.9:5555`, `[2001:db8::1]`, `2001:db8::1`},
+		{`10.9.9.9:5555`, `2001:db8::1`, `2001:db8::1`},
+		// an entry that isn't an address is no use, so we fall back to the connection
+		{`10.9.9.9:5555`, `unknown`, `10.9.9.9`},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(`GET`, `/staging/`, nil)
+		r.RemoteAddr = test.remote
+		if test.forwarded != `` {
+			r.Header.Set(`X-Forwarded-For`, test.forwarded)
+		}
+		if ip := ClientIP(r); ip.String() != test.expected {
+			t.Errorf(`%v via %q: got %v, expected %v`, test.remote, test.forwarded, ip, test.expected)
+		}
+	}
+
+	cfg.Config.Proxies.Hops = nil
+	r := httptest.NewRequest(`GET`, `/staging/`, nil)
+	r.RemoteAddr = `203.0.113.5:5555`
+	r.Header.Set(`X-Forwarded-For`, `10.0.0.1`)
+	if ip := ClientIP(r); ip.String() != `203.0.113.5` {
+		t.Errorf(`X-Forwarded-For trusted without proxies, got %v`, ip)
+	}
+}
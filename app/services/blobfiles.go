@@ -0,0 +1,102 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/elephant-insurance/go-microservice-arch/v2/log"
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+)
+
+// blobFileRelease marks snapshots that hold a single file synced straight into the container, rather than a release
+const blobFileRelease = `blob`
+
+// FindFileInCache returns the snapshot holding the document at docPath of a project served blob by blob,
+// and whether it is fresh enough to serve without checking the container.
+func FindFileInCache(docPath string) (*Snapshot, bool) {
+	return FindInCache(docPath, blobFileRelease)
+}
+
+// DownloadFile fetches the blob at docPath for a project served blob by blob, and caches it as a single-file snapshot.
+// If we already have the file, we only download it again if its blob has changed.
+func (bs *BlobService) DownloadFile(c msrqc.Context, project, docPath string) (int, error) {
+	lw := log.ForFunc(c).SetName(docPath)
+	// the document is the blob name, so it must be one of the project's
+	if !ValidProjectName(project) || !strings.HasPrefix(docPath, project+`/`) || path.Clean(docPath) != docPath {
+		return http.StatusBadRequest, ErrBadPath
+	}
+	if docPath == project+`/`+SiteManifestName {
+		return http.StatusNotFound, ErrNotFound
+	}
+	key := siteKey(docPath, blobFileRelease)
+	old, _ := FindFileInCache(docPath)
+	if old == nil {
+		if knownMissing(key) {
+			return http.StatusNotFound, ErrNotFound
+		}
+		if !allowFileLookup(project) {
+			lw.Warn("too many lookups of missing files")
+			return http.StatusServiceUnavailable, ErrLookupThrottled
+		}
+	}
+
+	client, err := bs.initializeClient(c)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	options := &azblob.DownloadStreamOptions{}
+	if old != nil && old.ETag != `` {
+		etag := azcore.ETag(old.ETag)
+		options.AccessConditions = &blob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfNoneMatch: &etag},
+		}
+	}
+
+	dr, err := client.DownloadStream(c, bs.containerName, blobPath(docPath), options)
+	if err != nil {
+		kind, status := ClassifyError(err)
+		if kind == ErrorNotFound {
+			spendFileMiss(project)
+			rememberMissing(key)
+		} else {
+			lw.WithError(err).WithConsoleField("kind", kind).Error("error downloading blob")
+		}
+		return status, err
+	}
+	defer dr.Body.Close()
+
+	if old != nil && dr.ETag != nil && string(*dr.ETag) == old.ETag {
+		// not modified
+		old.touch()
+		return http.StatusOK, nil
+	}
+
+	snap := newSnapshot(project)
+	f, err := snap.readFile(dr.Body, newLimitTracker(nil))
+	if err != nil {
+		var le *LimitError
+		if errors.As(err, &le) {
+			recordLimitBreach(c, project, le)
+		}
+		snap.discard()
+		lw.WithError(err).Error("error reading blob")
+		return http.StatusInternalServerError, err
+	}
+
+	snap.Release = blobFileRelease
+	snap.Source = docPath
+	if dr.ETag != nil {
+		snap.ETag = string(*dr.ETag)
+	}
+	snap.files[docPath] = f
+	cache.Set(key, snap, 0)
+	old.retire()
+
+	return http.StatusOK, nil
+}
@@ -1,18 +1,18 @@
 package services
 
 import (
-	"archive/tar"
-	"bytes"
-	"compress/gzip"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/elephant-insurance/go-microservice-arch/v2/log"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
 	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
 	goCache "github.com/patrickmn/go-cache"
 )
@@ -21,98 +21,182 @@ type BlobService struct {
 	accountName   string
 	accountKey    string
 	containerName string
-	client        *azblob.Client
+	// serviceURL is where the storage account is, if not in Azure: the emulator, or a stub in tests
+	serviceURL string
+
+	// the client is made once and shared, since requests, warm-up and refreshes all use it at the same time
+	clientOnce sync.Once
+	client     *azblob.Client
+	clientErr  error
 }
 
 var Blob *BlobService
 
+var ErrArchiveInvalid = errors.New(`archive failed validation`)
+
 const (
+	// snapshots are checked against the container after cacheExpirationSeconds,
+	// but kept for cacheRetentionSeconds in case the container copy turns out to be bad
 	cacheExpirationSeconds = 30
+	cacheRetentionSeconds  = 60 * 60
 	cachePurgeSeconds      = 60
+
+	// DefaultRelease is the release served from the original <project>.tar.gz (or .zip) archive
+	DefaultRelease = `default`
+	releasesFolder = `releases`
 )
 
-var cache = goCache.New(cacheExpirationSeconds*time.Second, cachePurgeSeconds*time.Second)
+var cache = goCache.New(cacheRetentionSeconds*time.Second, cachePurgeSeconds*time.Second)
 
 func NewBlobService(name, key, cName string) *BlobService {
-	bs := BlobService{accountName: name, accountKey: key, containerName: cName}
+	return NewBlobServiceAt(``, name, key, cName)
+}
+
+// NewBlobServiceAt is NewBlobService for a storage account at serviceURL, such as the Azurite emulator, rather than in Azure
+func NewBlobServiceAt(serviceURL, name, key, cName string) *BlobService {
+	bs := BlobService{accountName: name, accountKey: key, containerName: cName, serviceURL: serviceURL}
+	cache.OnEvicted(func(_ string, cached interface{}) { cached.(*Snapshot).retire() })
 	return &bs
 }
 
+// initializeClient returns the client for the storage account, making it the first time it is asked for
 func (bs *BlobService) initializeClient(c msrqc.Context) (*azblob.Client, error) {
-	blobURL := fmt.Sprintf("https://%s.blob.core.windows.net/", bs.accountName)
-	credential, _ := azblob.NewSharedKeyCredential(bs.accountName, bs.accountKey)
-	fmt.Print(blobURL)
-	client, err := azblob.NewClientWithSharedKeyCredential(blobURL, credential, nil)
-	return client, err
+	bs.clientOnce.Do(func() {
+		blobURL := fmt.Sprintf("https://%s.blob.core.windows.net/", bs.accountName)
+		if bs.serviceURL != `` {
+			blobURL = strings.TrimSuffix(bs.serviceURL, `/`) + `/` + bs.accountName + `/`
+		}
+		credential, _ := azblob.NewSharedKeyCredential(bs.accountName, bs.accountKey)
+		bs.client, bs.clientErr = azblob.NewClientWithSharedKeyCredential(blobURL, credential, nil)
+	})
 
+	return bs.client, bs.clientErr
 }
 
-func (bs *BlobService) ensureContainer(c msrqc.Context) error {
+func (bs *BlobService) ensureContainer(c msrqc.Context, client *azblob.Client) error {
 
-	_, err := bs.client.CreateContainer(c, bs.containerName, &azblob.CreateContainerOptions{})
+	_, err := client.CreateContainer(c, bs.containerName, &azblob.CreateContainerOptions{})
 	return err
 
 }
 
-func (bs *BlobService) DownloadFiles(c msrqc.Context, name string) (error, int) {
+// findArchive downloads the first blob holding the given release of project, looking under each of ArchiveNames in turn.
+// If we already know the name of the blob we try it first.
+func (bs *BlobService) findArchive(c msrqc.Context, client *azblob.Client, project, release, known string, options *azblob.DownloadStreamOptions) (azblob.DownloadStreamResponse, string, error) {
+	names := ArchiveNames(project, release)
+	if len(names) == 0 {
+		return azblob.DownloadStreamResponse{}, ``, ErrNotFound
+	}
+	if known != `` {
+		names = append([]string{known}, names...)
+	}
+
+	var (
+		dr  azblob.DownloadStreamResponse
+		err error
+	)
+	for _, name := range names {
+		dr, err = client.DownloadStream(c, bs.containerName, blobPath(name), options)
+		if err == nil || !isNotFound(err) {
+			return dr, name, err
+		}
+	}
+
+	return dr, ``, err
+}
+
+func (bs *BlobService) DownloadFiles(c msrqc.Context, name, release string) (error, int) {
 	lw := log.ForFunc(c)
-	var downloadedData bytes.Buffer
+	// the project and release become blob names, so they mustn't be able to reach any others
+	if !ValidProjectName(name) || strings.ContainsAny(release, `/\`) || strings.Contains(release, `..`) {
+		return ErrBadProject, http.StatusNotFound
+	}
+	key := siteKey(name, release)
+	old, _ := FindInCache(name, release)
+	if old == nil {
+		if knownMissing(key) {
+			return ErrNotFound, http.StatusNotFound
+		}
+		if !allowLookup(name) {
+			lw.SetName(name).Warn("too many lookups of unknown projects")
+			return ErrLookupThrottled, http.StatusServiceUnavailable
+		}
+	}
+
 	client, err := bs.initializeClient(c)
 	if err != nil {
 		return err, http.StatusInternalServerError
 	}
-	bs.client = client
 
-	blobName := name + `.tar.gz`
+	known := ``
+	options := &azblob.DownloadStreamOptions{}
+	if old != nil {
+		known = old.Source
+		if old.ETag != `` {
+			etag := azcore.ETag(old.ETag)
+			options.AccessConditions = &blob.AccessConditions{
+				ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfNoneMatch: &etag},
+			}
+		}
+	}
 
-	dr, err := bs.client.DownloadStream(c, bs.containerName, blobName, nil)
+	dr, blobName, err := bs.findArchive(c, client, name, release, known, options)
 	if err != nil {
-		lw.WithError(err).Error("error downloading blob stream")
-		blobError := err.(*azcore.ResponseError)
-		return err, blobError.StatusCode
+		kind, status := ClassifyError(err)
+		if kind == ErrorNotFound {
+			rememberMissing(key)
+		} else {
+			lw.WithError(err).WithConsoleField("kind", kind).Error("error downloading blob stream")
+		}
+		return err, status
 	}
-	resp := dr.Body
-	lw.Debug(*dr.ContentType)
-
-	actualBlobData, errRead := io.ReadAll(resp)
-	if errRead != nil {
-		lw.WithError(errRead).Error("error reading blob download response body")
-		return errRead, http.StatusInternalServerError
+	rememberFound(name, key)
+	if old != nil && blobName == old.Source && dr.ETag != nil && string(*dr.ETag) == old.ETag {
+		// not modified
+		dr.Body.Close()
+		old.touch()
+		return nil, http.StatusOK
 	}
-
-	errClose := resp.Close()
-	if errClose != nil {
-		lw.WithError(errClose).Error("error closing blob stream")
+	snap, report := extractDownload(c, name, release, blobName, dr)
+	if snap == nil {
+		if old != nil {
+			// never replace a good snapshot with a bad one
+			old.touch()
+			return nil, http.StatusOK
+		}
+		if report.Limit != nil {
+			return report.Limit, http.StatusInternalServerError
+		}
+		return ErrArchiveInvalid, http.StatusInternalServerError
 	}
-	downloadedData = *bytes.NewBuffer(actualBlobData)
-	bs.unzipTar(c, downloadedData)
+
+	cache.Set(key, snap, 0)
+	old.retire()
+	go disk.store(key, snap)
 	return nil, http.StatusOK
 }
 
-func (bs *BlobService) unzipTar(c msrqc.Context, buff bytes.Buffer) {
+// extractDownload extracts release of project straight from the download of blobName, without holding the archive in memory.
+// The snapshot is nil if the archive fails validation, and the report says why.
+func extractDownload(c msrqc.Context, project, release, blobName string, dr azblob.DownloadStreamResponse) (*Snapshot, *ArchiveReport) {
 	lw := log.ForFunc(c)
-	archive, err := gzip.NewReader(&buff)
-	if err != nil {
-		lw.WithError(err).Error("error creating new gzip reader")
-	}
-	tr := tar.NewReader(archive)
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break // End of archive
-		}
-		if err != nil {
-			lw.WithError(err).Error("invalid tar header")
-		}
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-		case tar.TypeReg:
-			buf, errRead := io.ReadAll(tr)
-			if errRead != nil {
-				lw.SetName(hdr.Name).WithError(errRead).Error("error reading a fil for tarball")
-			}
-			// set the cache with key as file path (hdr.Name) and []byte as value
-			cache.Set(hdr.Name, buf, 0)
+	defer func() {
+		if errClose := dr.Body.Close(); errClose != nil {
+			lw.WithError(errClose).Error("error closing blob stream")
 		}
+	}()
+	snap, report := extractArchive(c, project, dr.Body)
+	if !report.Valid {
+		snap.discard()
+		lw.SetName(blobName).WithConsoleField("problems", report.Problems).Error("archive failed validation")
+		return nil, report
+	}
+
+	snap.Release = release
+	snap.Source = blobName
+	if dr.ETag != nil {
+		snap.ETag = string(*dr.ETag)
 	}
+
+	return snap, report
 }
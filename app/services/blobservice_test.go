@@ -0,0 +1,142 @@
+package services
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+// stubContainer is just enough of a blob container for the BlobService: blobs can be read, written and deleted
+type stubContainer struct {
+	sync.Mutex
+	blobs map[string][]byte
+	gets  map[string]int
+}
+
+// newStubContainer starts a stub container holding blobs, and returns it with a BlobService that uses it
+func newStubContainer(t *testing.T, blobs map[string][]byte) (*stubContainer, *BlobService) {
+	sc := &stubContainer{blobs: blobs, gets: map[string]int{}}
+	server := httptest.NewServer(sc)
+	t.Cleanup(server.Close)
+
+	return sc, NewBlobServiceAt(server.URL, `sites`, ``, `sites`)
+}
+
+func (sc *stubContainer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sc.Lock()
+	defer sc.Unlock()
+	name := strings.TrimPrefix(r.URL.Path, `/sites/sites/`)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		sc.gets[name]++
+		data, found := sc.blobs[name]
+		if !found {
+			w.Header().Set(`x-ms-error-code`, `BlobNotFound`)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		etag := fmt.Sprintf(`"%x"`, md5.Sum(data))
+		if r.Header.Get(`If-None-Match`) == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set(`ETag`, etag)
+		w.Header().Set(`Content-Length`, fmt.Sprint(len(data)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		sc.blobs[name] = data
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		delete(sc.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// set replaces a blob
+func (sc *stubContainer) set(name string, data []byte) {
+	sc.Lock()
+	defer sc.Unlock()
+	sc.blobs[name] = data
+}
+
+// getCount is how often a blob has been asked for
+func (sc *stubContainer) getCount(name string) int {
+	sc.Lock()
+	defer sc.Unlock()
+	return sc.gets[name]
+}
+
+func TestBlobServiceSharedClient(t *testing.T) {
+	_, bs := newStubContainer(t, map[string][]byte{`releases/shared/active`: []byte(`v2`)})
+	defer activeReleases.Flush()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := msrqc.New(context.Background())
+			if _, err := bs.initializeClient(c); err != nil {
+				t.Error(err)
+			}
+			if release := bs.ActiveRelease(c, `shared`); release != `v2` {
+				t.Errorf(`expected active release v2, got %v`, release)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRefreshKeepsGoodSnapshot(t *testing.T) {
+	c := msrqc.New(context.Background())
+	defer func() { cfg.Config = nil; Purge(``) }()
+	cfg.Config = &cfg.AppConfig{}
+	site := func(body string) []byte {
+		return makeTarGz(t, []testEntry{{`index.html`, tar.TypeReg, body}})
+	}
+	sc, bs := newStubContainer(t, map[string][]byte{`docs.tar.gz`: site(`v1`), `releases/docs/active`: []byte(DefaultRelease)})
+	if err, _ := bs.DownloadFiles(c, `docs`, DefaultRelease); err != nil {
+		t.Fatal(err)
+	}
+
+	served := func() string {
+		snap, _ := FindInCache(`docs`, DefaultRelease)
+		doc, _, err := snap.Open(`docs/index.html`)
+		if err != nil {
+			return err.Error()
+		}
+		defer doc.Close()
+		data, _ := io.ReadAll(doc)
+		return string(data)
+	}
+
+	sc.set(`docs.tar.gz`, []byte(`not an archive`))
+	if _, err := bs.Refresh(c, `docs`); err == nil {
+		t.Error(`expected refresh from a bad archive to fail`)
+	}
+	if body := served(); body != `v1` {
+		t.Errorf(`expected the good snapshot to be served after a failed refresh, got %q`, body)
+	}
+
+	sc.set(`docs.tar.gz`, site(`v2`))
+	if _, err := bs.Refresh(c, `docs`); err != nil {
+		t.Fatal(err)
+	}
+	if body := served(); body != `v2` {
+		t.Errorf(`expected the new snapshot after refresh, got %q`, body)
+	}
+}
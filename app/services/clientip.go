@@ -0,0 +1,55 @@
+package services
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+// forwardedForHeader lists the addresses a request has come through, each proxy adding the one it got it from
+const forwardedForHeader = `X-Forwarded-For`
+
+// ClientIP is the address of the client, as far as we can trust it.
+// With Hops under Proxies, it is the entry of X-Forwarded-For that the outermost of our proxies added;
+// anything before that the client could have written itself, falling back to the address of the connection if it isn't an address.
+// Without, it is the address of the connection.
+func ClientIP(r *http.Request) net.IP {
+	remote := parseHostIP(r.RemoteAddr)
+	hops := 0
+	if cfg.Config != nil && cfg.Config.Proxies.Hops != nil {
+		hops = *cfg.Config.Proxies.Hops
+	}
+	if hops <= 0 {
+		return remote
+	}
+
+	forwarded := []string{}
+	for _, header := range r.Header.Values(forwardedForHeader) {
+		for _, entry := range strings.Split(header, `,`) {
+			if entry = strings.TrimSpace(entry); entry != `` {
+				forwarded = append(forwarded, entry)
+			}
+		}
+	}
+	// a request with fewer entries than we have proxies didn't come through all of them
+	if len(forwarded) < hops {
+		return remote
+	}
+	if ip := parseHostIP(forwarded[len(forwarded)-hops]); ip != nil {
+		return ip
+	}
+
+	return remote
+}
+
+// parseHostIP parses an address that may come with a port, as 1.2.3.4:5678 or [::1]:5678, or in brackets, as [::1]
+func parseHostIP(address string) net.IP {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, `[`), `]`))
+}
@@ -10,15 +10,14 @@ import (
 
 func TestContainer() (dig.DiagnosticResult, error) {
 	c := msrqc.New(nil)
-	blobService := NewBlobService(cfg.Config.StorageAccountName, cfg.Config.StorageAccountKey, "singlesearch")
+	blobService := NewBlobServiceAt(cfg.Config.StorageServiceURL, cfg.Config.StorageAccountName, cfg.Config.StorageAccountKey, "singlesearch")
 	client, err := blobService.initializeClient(c)
 	if err != nil {
 		rp := dig.NewResult().Fail().SetDescription("Client initialization failed")
 		return *rp, nil
 	}
-	blobService.client = client
 
-	err = blobService.ensureContainer(c)
+	err = blobService.ensureContainer(c, client)
 
 	res := strings.Contains(err.Error(), "ContainerAlreadyExists")
 	if res {
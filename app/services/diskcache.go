@@ -0,0 +1,383 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/clicker"
+	"github.com/elephant-insurance/go-microservice-arch/v2/log"
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+const (
+	defaultDiskCacheBytes = 1 << 30
+	diskManifestName      = `manifest.json`
+	diskFilesFolder       = `files`
+	// snapshots are written under a temporary name and renamed into place when complete
+	diskTempPrefix = `.tmp-`
+)
+
+var (
+	// disk is the second-tier cache, or nil if there isn't one
+	disk *diskCache
+
+	DiskHits   *clicker.Clicker = &clicker.Clicker{}
+	DiskWrites *clicker.Clicker = &clicker.Clicker{}
+)
+
+// diskCache keeps extracted snapshots on local disk, so that a restarted pod doesn't have to download them all again.
+// Each snapshot is stored in its own folder, named for its cache key and the ETag of the archive it came from,
+// holding a manifest and the snapshot's files.
+type diskCache struct {
+	dir      string
+	maxBytes int64
+	// usage is the size of each snapshot folder we know of
+	usage map[string]int64
+	sync.Mutex
+}
+
+// diskManifest describes a snapshot stored on disk
+type diskManifest struct {
+	Key     string                      `json:"key"`
+	Project string                      `json:"project"`
+	Release string                      `json:"release"`
+	Source  string                      `json:"source"`
+	ETag    string                      `json:"etag"`
+	Stored  time.Time                   `json:"stored"`
+	Site    SiteManifest                `json:"site"`
+	Files   map[string]diskManifestFile `json:"files"`
+}
+
+type diskManifestFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	ETag string `json:"etag"`
+}
+
+// InitializeDiskCache sets up the disk cache, if one is configured, and checks what is already in it.
+// Anything incomplete or unreadable, left over from a crash perhaps, is removed.
+func InitializeDiskCache(c context.Context) error {
+	if cfg.Config == nil || cfg.Config.DiskCache.Dir == `` {
+		return nil
+	}
+
+	lw := log.ForFunc(c)
+	dc := &diskCache{dir: cfg.Config.DiskCache.Dir, maxBytes: defaultDiskCacheBytes, usage: map[string]int64{}}
+	if mb := cfg.Config.DiskCache.MaxBytes; mb != nil && *mb > 0 {
+		dc.maxBytes = int64(*mb)
+	}
+	if err := os.MkdirAll(dc.dir, 0o755); err != nil {
+		lw.WithError(err).Error("error creating disk cache folder")
+		return err
+	}
+
+	entries, err := os.ReadDir(dc.dir)
+	if err != nil {
+		lw.WithError(err).Error("error reading disk cache folder")
+		return err
+	}
+	for _, entry := range entries {
+		folder := filepath.Join(dc.dir, entry.Name())
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), diskTempPrefix) {
+			os.RemoveAll(folder)
+			continue
+		}
+		size, err := dc.check(folder)
+		if err != nil {
+			lw.SetName(entry.Name()).WithError(err).Warn("removing invalid disk cache entry")
+			os.RemoveAll(folder)
+			continue
+		}
+		dc.usage[folder] = size
+	}
+
+	dc.Lock()
+	dc.evict(``)
+	dc.Unlock()
+
+	disk = dc
+	lw.WithConsoleField("entries", len(dc.usage)).Info("disk cache ready")
+	return nil
+}
+
+// check makes sure every file in the manifest of the snapshot in folder is there, and returns their total size
+func (dc *diskCache) check(folder string) (int64, error) {
+	m, err := readManifest(folder)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for docPath, f := range m.Files {
+		info, err := os.Stat(filepath.Join(folder, diskFilesFolder, f.Name))
+		if err != nil {
+			return 0, err
+		}
+		if info.Size() != f.Size {
+			return 0, errors.New(`wrong size for ` + docPath)
+		}
+		total += f.Size
+	}
+
+	return total, nil
+}
+
+func readManifest(folder string) (*diskManifest, error) {
+	data, err := os.ReadFile(filepath.Join(folder, diskManifestName))
+	if err != nil {
+		return nil, err
+	}
+	m := &diskManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// folderFor is where we keep the snapshot for key that came from the archive with the given ETag
+func (dc *diskCache) folderFor(key, etag string) string {
+	return filepath.Join(dc.dir, diskName(key)+`-`+diskName(etag))
+}
+
+// diskName turns a cache key or ETag into something safe to use as a file name
+func diskName(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
+
+// load returns the newest snapshot stored for key, if there is one
+func (dc *diskCache) load(key string) *Snapshot {
+	if dc == nil {
+		return nil
+	}
+
+	dc.Lock()
+	defer dc.Unlock()
+
+	var newest *diskManifest
+	var newestFolder string
+	prefix := filepath.Join(dc.dir, diskName(key)) + `-`
+	for folder := range dc.usage {
+		if !strings.HasPrefix(folder, prefix) {
+			continue
+		}
+		m, err := readManifest(folder)
+		if err != nil || m.Key != key {
+			continue
+		}
+		if newest == nil || m.Stored.After(newest.Stored) {
+			newest, newestFolder = m, folder
+		}
+	}
+	if newest == nil {
+		return nil
+	}
+	if access := newest.Site.Access; access != `` && cfg.Config.CheckAccess(access) != nil {
+		// stored under other security settings; extracting the archive again will say why it can't be served
+		return nil
+	}
+
+	snap := newSnapshot(newest.Project)
+	snap.Release = newest.Release
+	snap.Source = newest.Source
+	snap.ETag = newest.ETag
+	snap.Manifest = newest.Site
+	snap.diskFolder = newestFolder
+	// we don't know whether the archive has changed since we stored it, so make sure before serving it.
+	// The check only downloads the archive again if its ETag has changed.
+	snap.checked = time.Time{}
+	for docPath, f := range newest.Files {
+		snap.files[docPath] = &snapshotFile{path: filepath.Join(newestFolder, diskFilesFolder, f.Name), size: f.Size, etag: f.ETag}
+	}
+	// remember that we have used this one, so that it is evicted last
+	rn := time.Now()
+	os.Chtimes(newestFolder, rn, rn)
+	DiskHits.Click(1)
+
+	return snap
+}
+
+// store writes snap to disk, unless we already have it, and removes any older copies of the same release.
+// It runs after the request that loaded the snapshot has gone, so it logs with its own context.
+func (dc *diskCache) store(key string, snap *Snapshot) {
+	if dc == nil || snap.ETag == `` {
+		return
+	}
+
+	lw := log.ForFunc(msrqc.New(context.Background())).SetName(key)
+	folder := dc.folderFor(key, snap.ETag)
+	dc.Lock()
+	_, exists := dc.usage[folder]
+	if !exists {
+		// claim the folder, so that nobody else writes it while we do
+		dc.usage[folder] = 0
+	}
+	dc.Unlock()
+	if exists {
+		return
+	}
+
+	temp, err := os.MkdirTemp(dc.dir, diskTempPrefix)
+	if err == nil {
+		err = os.Mkdir(filepath.Join(temp, diskFilesFolder), 0o755)
+	}
+	if err != nil {
+		lw.WithError(err).Error("error creating disk cache entry")
+		dc.abandon(folder, temp)
+		return
+	}
+
+	m := &diskManifest{
+		Key: key, Project: snap.Project, Release: snap.Release, Source: snap.Source, ETag: snap.ETag,
+		Stored: snap.Loaded, Site: snap.Manifest, Files: map[string]diskManifestFile{},
+	}
+	var total int64
+	i := 0
+	for docPath := range snap.files {
+		i++
+		name := strconv.Itoa(i)
+		size, err := copySnapshotFile(snap, docPath, filepath.Join(temp, diskFilesFolder, name))
+		if err != nil {
+			lw.WithError(err).Error("error writing disk cache entry")
+			dc.abandon(folder, temp)
+			return
+		}
+		m.Files[docPath] = diskManifestFile{Name: name, Size: size, ETag: snap.FileETag(docPath)}
+		total += size
+	}
+
+	data, err := json.Marshal(m)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(temp, diskManifestName), data, 0o644)
+	}
+	if err == nil {
+		err = os.Rename(temp, folder)
+	}
+	if err != nil {
+		lw.WithError(err).Error("error writing disk cache manifest")
+		dc.abandon(folder, temp)
+		return
+	}
+	DiskWrites.Click(1)
+
+	dc.Lock()
+	defer dc.Unlock()
+	dc.usage[folder] = total
+	prefix := filepath.Join(dc.dir, diskName(key)) + `-`
+	for other := range dc.usage {
+		if other != folder && strings.HasPrefix(other, prefix) {
+			dc.drop(other)
+		}
+	}
+	dc.evict(folder)
+}
+
+// abandon gives up on writing a snapshot to folder
+func (dc *diskCache) abandon(folder, temp string) {
+	os.RemoveAll(temp)
+
+	dc.Lock()
+	defer dc.Unlock()
+	delete(dc.usage, folder)
+}
+
+func copySnapshotFile(snap *Snapshot, docPath, to string) (int64, error) {
+	in, _, err := snap.Open(docPath)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := os.Create(to)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(out, in)
+	if errClose := out.Close(); err == nil {
+		err = errClose
+	}
+
+	return size, err
+}
+
+// evict removes the least recently used snapshots until we are within budget, keeping the one in keep.
+// The caller must hold the lock.
+func (dc *diskCache) evict(keep string) {
+	var total int64
+	folders := []string{}
+	for folder, size := range dc.usage {
+		total += size
+		folders = append(folders, folder)
+	}
+	if total <= dc.maxBytes {
+		return
+	}
+
+	used := map[string]time.Time{}
+	for _, folder := range folders {
+		if info, err := os.Stat(folder); err == nil {
+			used[folder] = info.ModTime()
+		}
+	}
+	sort.Slice(folders, func(i, j int) bool { return used[folders[i]].Before(used[folders[j]]) })
+
+	for _, folder := range folders {
+		if total <= dc.maxBytes {
+			break
+		}
+		if folder == keep {
+			continue
+		}
+		total -= dc.usage[folder]
+		dc.drop(folder)
+	}
+}
+
+// drop removes the snapshot in folder from the disk cache, and from memory if it was loaded from there, since its files are gone.
+// The caller must hold the lock.
+func (dc *diskCache) drop(folder string) {
+	if m, err := readManifest(folder); err == nil {
+		if cached, found := cache.Get(m.Key); found && cached.(*Snapshot).diskFolder == folder {
+			cache.Delete(m.Key)
+		}
+	}
+	os.RemoveAll(folder)
+	delete(dc.usage, folder)
+}
+
+// DiskCacheDiagnostics reports what is in the disk cache
+func DiskCacheDiagnostics() map[string]interface{} {
+	rtn := map[string]interface{}{
+		`enabled`: disk != nil,
+		`hits`:    DiskHits.Clicks,
+		`writes`:  DiskWrites.Clicks,
+	}
+	if disk == nil {
+		return rtn
+	}
+
+	disk.Lock()
+	defer disk.Unlock()
+	var total int64
+	for _, size := range disk.usage {
+		total += size
+	}
+	rtn[`entries`] = len(disk.usage)
+	rtn[`bytes`] = total
+	rtn[`max-bytes`] = disk.maxBytes
+
+	return rtn
+}
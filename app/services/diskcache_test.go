@@ -0,0 +1,115 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+func TestDiskCache(t *testing.T) {
+	c := msrqc.New(context.Background())
+	dir := t.TempDir()
+	defer func() { cfg.Config, disk = nil, nil }()
+	cfg.Config = &cfg.AppConfig{DiskCache: cfg.DiskCacheSettings{Dir: dir}}
+	if err := InitializeDiskCache(c); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, report := extractArchive(c, `docs`, bytes.NewReader(makeTarGz(t, archiveTests[0].entries)))
+	if !report.Valid {
+		t.Fatalf(`archive rejected: %v`, report.Problems)
+	}
+	snap.ETag = `"0x1"`
+	disk.store(siteKey(`docs`, ``), snap)
+
+	// a half-written entry, as if we crashed while storing it
+	os.Mkdir(filepath.Join(dir, diskTempPrefix+`crashed`), 0o755)
+	// and an entry whose files have gone missing
+	broken := disk.folderFor(siteKey(`other`, ``), `"0x2"`)
+	os.MkdirAll(filepath.Join(broken, diskFilesFolder), 0o755)
+	os.WriteFile(filepath.Join(broken, diskManifestName), []byte(`{"key":"other@default","files":{"other/index.html":{"name":"1","size":3}}}`), 0o644)
+
+	// restart
+	disk = nil
+	if err := InitializeDiskCache(c); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf(`expected only the good entry to survive a restart, found %v`, len(entries))
+	}
+
+	loaded := disk.load(siteKey(`docs`, ``))
+	if loaded == nil {
+		t.Fatal(`snapshot not found on disk`)
+	}
+	if loaded.ETag != snap.ETag || loaded.fresh() {
+		t.Error(`snapshot from disk should keep its ETag and need checking against the container`)
+	}
+	doc, _, err := loaded.Open(`docs/site.css`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(doc)
+	doc.Close()
+	if string(data) != `body{}` || loaded.FileETag(`docs/site.css`) != snap.FileETag(`docs/site.css`) {
+		t.Errorf(`file from disk doesn't match: %q`, data)
+	}
+}
+
+func TestDiskCacheEvictDropsLoadedSnapshot(t *testing.T) {
+	c := msrqc.New(context.Background())
+	defer func() { cfg.Config, disk = nil, nil; cache.Flush() }()
+	cfg.Config = &cfg.AppConfig{DiskCache: cfg.DiskCacheSettings{Dir: t.TempDir()}}
+	if err := InitializeDiskCache(c); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, project := range []string{`docs`, `other`} {
+		snap, report := extractArchive(c, project, bytes.NewReader(makeTarGz(t, archiveTests[0].entries)))
+		if !report.Valid {
+			t.Fatalf(`archive rejected: %v`, report.Problems)
+		}
+		snap.ETag = `"0x` + strconv.Itoa(i) + `"`
+		disk.store(siteKey(project, ``), snap)
+		if i == 0 {
+			// serve docs from disk, and then leave room on disk for only one snapshot
+			if loaded, _ := FindInCache(`docs`, ``); loaded == nil || loaded.diskFolder == `` {
+				t.Fatal(`snapshot not loaded from disk`)
+			}
+			disk.maxBytes = disk.usage[disk.folderFor(siteKey(`docs`, ``), snap.ETag)]
+		}
+	}
+
+	if _, found := cache.Get(siteKey(`docs`, ``)); found {
+		t.Error(`snapshot still cached after its files were evicted from disk`)
+	}
+}
+
+func TestDiskCacheRefusesUnsupportedAccess(t *testing.T) {
+	c := msrqc.New(context.Background())
+	defer func() { cfg.Config, disk = nil, nil }()
+	cfg.Config = &cfg.AppConfig{DiskCache: cfg.DiskCacheSettings{Dir: t.TempDir()}}
+	if err := InitializeDiskCache(c); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, report := extractArchive(c, `docs`, bytes.NewReader(makeTarGz(t, archiveTests[0].entries)))
+	if !report.Valid {
+		t.Fatalf(`archive rejected: %v`, report.Problems)
+	}
+	// stored while login was configured
+	snap.Manifest.Access = cfg.AccessLogin
+	snap.ETag = `"0x1"`
+	disk.store(siteKey(`docs`, ``), snap)
+
+	if loaded := disk.load(siteKey(`docs`, ``)); loaded != nil {
+		t.Error(`a snapshot whose access policy can't be checked should not be loaded from disk`)
+	}
+}
@@ -0,0 +1,124 @@
+package services
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// entryKind is what an archive entry holds, whatever the archive format
+type entryKind int
+
+const (
+	entryOther entryKind = iota
+	entryDir
+	entryFile
+	entrySymlink
+	entryHardLink
+)
+
+// maxLinkTargetBytes is the longest symlink target we will read from a zip file
+const maxLinkTargetBytes = 4096
+
+// archiveEntry is one entry in an archive, as seen by extractArchive
+type archiveEntry struct {
+	name string
+	kind entryKind
+	// typeName describes the entry's type when it is one we don't support
+	typeName string
+	// open returns the contents of a file entry
+	open func() (io.ReadCloser, error)
+	// linkTarget is where a link entry points, exactly as the archive gives it
+	linkTarget string
+}
+
+// entryIterator walks the entries of an archive; next returns io.EOF after the last one.
+// close releases anything the iterator holds once we are done with the archive.
+type entryIterator interface {
+	next() (*archiveEntry, error)
+	close()
+}
+
+// tarEntries walks a tarball
+type tarEntries struct {
+	tr *tar.Reader
+	// closer releases the decompressor, if it needs releasing
+	closer func()
+}
+
+func (te *tarEntries) next() (*archiveEntry, error) {
+	hdr, err := te.tr.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &archiveEntry{name: hdr.Name, typeName: string(hdr.Typeflag)}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		entry.kind = entryDir
+	case tar.TypeReg:
+		entry.kind = entryFile
+		entry.open = func() (io.ReadCloser, error) { return io.NopCloser(te.tr), nil }
+	case tar.TypeSymlink:
+		entry.kind = entrySymlink
+		entry.linkTarget = hdr.Linkname
+	case tar.TypeLink:
+		entry.kind = entryHardLink
+		entry.linkTarget = hdr.Linkname
+	}
+
+	return entry, nil
+}
+
+func (te *tarEntries) close() {
+	if te.closer != nil {
+		te.closer()
+	}
+}
+
+// zipEntries walks a zip file, spooled to a temporary file
+type zipEntries struct {
+	files []*zip.File
+	i     int
+	spool *os.File
+}
+
+func (ze *zipEntries) close() {
+	ze.spool.Close()
+	os.Remove(ze.spool.Name())
+}
+
+func (ze *zipEntries) next() (*archiveEntry, error) {
+	if ze.i >= len(ze.files) {
+		return nil, io.EOF
+	}
+	f := ze.files[ze.i]
+	ze.i++
+
+	mode := f.Mode()
+	entry := &archiveEntry{name: f.Name, typeName: mode.Type().String()}
+	switch {
+	case mode.IsDir():
+		entry.kind = entryDir
+	case mode.IsRegular():
+		entry.kind = entryFile
+		entry.open = f.Open
+	case mode&fs.ModeSymlink != 0:
+		// zip keeps a symlink's target as its contents
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		target, err := io.ReadAll(io.LimitReader(rc, maxLinkTargetBytes))
+		if err != nil {
+			return nil, err
+		}
+		entry.kind = entrySymlink
+		entry.linkTarget = string(target)
+	}
+
+	return entry, nil
+}
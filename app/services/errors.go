@@ -0,0 +1,62 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+// ErrorKind says what sort of trouble we had with the container
+type ErrorKind string
+
+const (
+	// ErrorNotFound means the blob or container isn't there
+	ErrorNotFound ErrorKind = `not-found`
+	// ErrorAuth means the container turned down our credentials, which is our configuration at fault
+	ErrorAuth ErrorKind = `auth`
+	// ErrorTransient means the request may well work if tried again: timeouts, throttling, network and DNS failures
+	ErrorTransient ErrorKind = `transient`
+	// ErrorOther is anything else
+	ErrorOther ErrorKind = `other`
+)
+
+// ClassifyError works out what sort of error we got from the container, and the status we should answer with.
+// Unlike casting to *azcore.ResponseError, it copes with errors that never got an HTTP response.
+func ClassifyError(err error) (ErrorKind, int) {
+	if errors.Is(err, ErrNotFound) {
+		return ErrorNotFound, http.StatusNotFound
+	}
+	if errors.Is(err, ErrLookupThrottled) {
+		return ErrorTransient, http.StatusServiceUnavailable
+	}
+
+	var blobError *azcore.ResponseError
+	if errors.As(err, &blobError) {
+		switch {
+		case blobError.StatusCode == http.StatusNotFound:
+			return ErrorNotFound, http.StatusNotFound
+		case blobError.StatusCode == http.StatusUnauthorized || blobError.StatusCode == http.StatusForbidden:
+			return ErrorAuth, http.StatusInternalServerError
+		case blobError.StatusCode == http.StatusRequestTimeout || blobError.StatusCode == http.StatusTooManyRequests ||
+			blobError.StatusCode >= http.StatusInternalServerError:
+			return ErrorTransient, http.StatusServiceUnavailable
+		}
+		return ErrorOther, http.StatusInternalServerError
+	}
+
+	var netError net.Error
+	if errors.As(err, &netError) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrorTransient, http.StatusServiceUnavailable
+	}
+
+	return ErrorOther, http.StatusInternalServerError
+}
+
+// isNotFound reports whether err means the blob isn't there
+func isNotFound(err error) bool {
+	kind, _ := ClassifyError(err)
+	return kind == ErrorNotFound
+}
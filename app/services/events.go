@@ -0,0 +1,193 @@
+package services
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/log"
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+// Event Grid event types we act on
+const (
+	EventSubscriptionValidation = `Microsoft.EventGrid.SubscriptionValidationEvent`
+	EventBlobCreated            = `Microsoft.Storage.BlobCreated`
+	EventBlobDeleted            = `Microsoft.Storage.BlobDeleted`
+)
+
+// what we did about a storage event
+const (
+	EventIgnored    = `ignored`
+	EventPurged     = `purged`
+	EventRefreshing = `refreshing`
+)
+
+// StorageEvent is an Azure Event Grid event, in the Event Grid schema
+type StorageEvent struct {
+	ID        string                 `json:"id"`
+	Topic     string                 `json:"topic"`
+	Subject   string                 `json:"subject"`
+	EventType string                 `json:"eventType"`
+	EventTime string                 `json:"eventTime"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+// ValidationCode returns the code we must echo back to confirm a new subscription
+func (e StorageEvent) ValidationCode() string {
+	code, _ := e.Data[`validationCode`].(string)
+	return code
+}
+
+// EventOutcome is what we did about one storage event
+type EventOutcome struct {
+	ID      string `json:"id,omitempty"`
+	Blob    string `json:"blob,omitempty"`
+	Project string `json:"project,omitempty"`
+	Release string `json:"release,omitempty"`
+	Action  string `json:"action"`
+}
+
+// blobEventTarget is the cached content a blob in the container belongs to
+type blobEventTarget struct {
+	project string
+	release string
+	// active is set for the blob naming a project's active release, which changes which release we serve
+	active bool
+}
+
+// BlobFromSubject returns the name of the blob an event subject refers to, if it is in our container.
+// Subjects look like /blobServices/default/containers/<container>/blobs/<blob name>.
+func (bs *BlobService) BlobFromSubject(subject string) (string, bool) {
+	prefix := `/blobServices/default/containers/` + bs.containerName + `/blobs/`
+	if !strings.HasPrefix(subject, prefix) {
+		return ``, false
+	}
+	name := strings.TrimPrefix(subject, prefix)
+
+	return name, name != ``
+}
+
+// eventTarget works out which project and release a blob belongs to:
+// <project>.<ext> is the default release, releases/<project>/<release>.<ext> a named one,
+// releases/<project>/active the active release pointer, and <project>/<path> a file of a blob mode project.
+func eventTarget(name string) (blobEventTarget, bool) {
+	parts := strings.Split(name, `/`)
+	switch {
+	case len(parts) == 1:
+		if project, ok := trimArchiveExtension(name); ok {
+			return blobEventTarget{project: project, release: DefaultRelease}, true
+		}
+	case len(parts) == 3 && parts[0] == releasesFolder:
+		if parts[2] == activeReleaseBlob {
+			return blobEventTarget{project: parts[1], active: true}, true
+		}
+		if release, ok := trimArchiveExtension(parts[2]); ok {
+			return blobEventTarget{project: parts[1], release: release}, true
+		}
+	case cfg.Config.ForProject(parts[0]).Mode == cfg.ModeBlob:
+		return blobEventTarget{project: parts[0], release: blobFileRelease}, true
+	}
+
+	return blobEventTarget{}, false
+}
+
+func trimArchiveExtension(name string) (string, bool) {
+	for _, ae := range archiveExtensions {
+		if strings.HasSuffix(name, ae.extension) && len(name) > len(ae.extension) {
+			return strings.TrimSuffix(name, ae.extension), true
+		}
+	}
+
+	return ``, false
+}
+
+// HandleStorageEvent brings the cache up to date with a change to a blob in the container.
+// A deleted archive is dropped from the cache. A new or replaced one is loaded again in the background
+// if we are serving it, so that visitors never wait for it, and otherwise just dropped.
+func (bs *BlobService) HandleStorageEvent(c msrqc.Context, event StorageEvent) EventOutcome {
+	rtn := EventOutcome{ID: event.ID, Action: EventIgnored}
+	if event.EventType != EventBlobCreated && event.EventType != EventBlobDeleted {
+		return rtn
+	}
+	name, ok := bs.BlobFromSubject(event.Subject)
+	if !ok {
+		return rtn
+	}
+	rtn.Blob = name
+	target, ok := eventTarget(name)
+	if !ok {
+		return rtn
+	}
+	rtn.Project, rtn.Release = target.project, target.release
+	lw := log.ForFunc(c).SetName(name).WithConsoleField("event", event.EventType)
+
+	if target.active {
+		// the project now serves a different release: forget which one it was and load it afresh
+		activeReleases.Delete(target.project)
+		if len(CachedSnapshots(target.project)) > 0 && event.EventType == EventBlobCreated {
+			rtn.Action = EventRefreshing
+			go bs.refreshInBackground(target.project, ``)
+		} else {
+			Purge(target.project)
+			rtn.Action = EventPurged
+		}
+		lw.WithConsoleField("action", rtn.Action).Info("active release changed")
+		return rtn
+	}
+
+	key := siteKey(target.project, target.release)
+	if target.release == blobFileRelease {
+		key = siteKey(name, blobFileRelease)
+	}
+	_, cached := cache.Get(key)
+	if cached && event.EventType == EventBlobCreated && target.release != blobFileRelease {
+		rtn.Action = EventRefreshing
+		go bs.refreshInBackground(target.project, target.release)
+	} else {
+		dropKey(key)
+		rtn.Action = EventPurged
+	}
+	lw.WithConsoleField("action", rtn.Action).Info("blob changed")
+
+	return rtn
+}
+
+// refreshInBackground loads release of project again, or every release we serve if release is empty.
+// It runs after the event that asked for it has been answered, so it logs with its own context.
+func (bs *BlobService) refreshInBackground(project, release string) {
+	c := msrqc.New(context.Background())
+	if release == `` {
+		if _, err := bs.Refresh(c, project); err != nil {
+			log.ForFunc(c).SetName(project).WithError(err).Error("error refreshing project after storage event")
+		}
+		return
+	}
+	if err, _ := bs.DownloadFiles(c, project, release); err != nil {
+		log.ForFunc(c).SetName(siteKey(project, release)).WithError(err).Error("error refreshing release after storage event")
+	}
+}
+
+// dropKey removes a single snapshot from memory and disk, and forgets if it was missing
+func dropKey(key string) {
+	cache.Delete(key)
+	missing.Delete(key)
+	disk.remove(key)
+}
+
+// remove deletes every stored copy of the snapshot for key
+func (dc *diskCache) remove(key string) {
+	if dc == nil {
+		return
+	}
+
+	dc.Lock()
+	defer dc.Unlock()
+	prefix := filepath.Join(dc.dir, diskName(key)) + `-`
+	for folder := range dc.usage {
+		if strings.HasPrefix(folder, prefix) {
+			dc.drop(folder)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+// loadEvents reads one of the sample Event Grid batches in testdata/events
+func loadEvents(t *testing.T, name string) []StorageEvent {
+	data, err := os.ReadFile(filepath.Join(`testdata`, `events`, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []StorageEvent{}
+	if err := json.Unmarshal(data, &events); err != nil {
+		t.Fatal(err)
+	}
+
+	return events
+}
+
+func TestHandleStorageEvents(t *testing.T) {
+	c := msrqc.New(context.Background())
+	defer func() { cfg.Config = nil; cache.Flush() }()
+	cfg.Config = &cfg.AppConfig{Projects: map[string]cfg.ProjectSettings{`handbook`: {Mode: cfg.ModeBlob}}}
+	bs := NewBlobService(`sites`, ``, `sites`)
+
+	if code := loadEvents(t, `validation.json`)[0].ValidationCode(); code != `512d38b6-c7b8-40c8-89fe-f46f9e9622b6` {
+		t.Errorf(`wrong validation code %q`, code)
+	}
+
+	// nothing is cached, so new blobs are only dropped
+	expected := []EventOutcome{
+		{Blob: `docs.tar.gz`, Project: `docs`, Release: DefaultRelease, Action: EventPurged},
+		{Blob: `releases/docs/v2.zip`, Project: `docs`, Release: `v2`, Action: EventPurged},
+		{Blob: `handbook/guide/index.html`, Project: `handbook`, Release: blobFileRelease, Action: EventPurged},
+	}
+	for i, event := range loadEvents(t, `blob-created.json`) {
+		outcome := bs.HandleStorageEvent(c, event)
+		outcome.ID = ``
+		if outcome != expected[i] {
+			t.Errorf(`event %v: expected %+v, got %+v`, i, expected[i], outcome)
+		}
+	}
+
+	cache.Set(siteKey(`docs`, DefaultRelease), newSnapshot(`docs`), 0)
+	deleted := loadEvents(t, `blob-deleted.json`)
+	if outcome := bs.HandleStorageEvent(c, deleted[0]); outcome.Action != EventPurged {
+		t.Errorf(`deleted archive not purged: %+v`, outcome)
+	}
+	if _, found := cache.Get(siteKey(`docs`, DefaultRelease)); found {
+		t.Error(`deleted archive still cached`)
+	}
+	if outcome := bs.HandleStorageEvent(c, deleted[1]); outcome.Action != EventIgnored {
+		t.Errorf(`event from another container not ignored: %+v`, outcome)
+	}
+}
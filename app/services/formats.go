@@ -0,0 +1,118 @@
+package services
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+)
+
+// ArchiveFormat identifies how a site archive is packed
+type ArchiveFormat string
+
+const (
+	FormatUnknown ArchiveFormat = ``
+	FormatTarGz   ArchiveFormat = `tar.gz`
+	FormatZip     ArchiveFormat = `zip`
+	FormatTarZst  ArchiveFormat = `tar.zst`
+)
+
+// zstdMaxWindow is the biggest zstd window we will decompress with, the same as the zstd command line's default
+const zstdMaxWindow = 1 << 27
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zipMagic  = []byte("PK\x03\x04")
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+	// archiveExtensions lists the blob names we look for, in the order we look for them
+	archiveExtensions = []struct {
+		extension string
+		format    ArchiveFormat
+	}{
+		{`.tar.gz`, FormatTarGz},
+		{`.tgz`, FormatTarGz},
+		{`.zip`, FormatZip},
+		{`.tar.zst`, FormatTarZst},
+	}
+)
+
+// DetectFormat works out the format of an archive from its first few bytes,
+// falling back to the extension of its name when the bytes aren't recognized
+func DetectFormat(name string, head []byte) ArchiveFormat {
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return FormatTarGz
+	case bytes.HasPrefix(head, zipMagic):
+		return FormatZip
+	case bytes.HasPrefix(head, zstdMagic):
+		return FormatTarZst
+	}
+
+	lower := strings.ToLower(name)
+	for _, ae := range archiveExtensions {
+		if strings.HasSuffix(lower, ae.extension) {
+			return ae.format
+		}
+	}
+
+	return FormatUnknown
+}
+
+// Extension is the extension we give to blobs of this format
+func (f ArchiveFormat) Extension() string {
+	if f == FormatUnknown {
+		return ``
+	}
+
+	return `.` + string(f)
+}
+
+// MIMEType is the content type we give to blobs of this format
+func (f ArchiveFormat) MIMEType() string {
+	switch f {
+	case FormatTarGz:
+		return `application/gzip`
+	case FormatZip:
+		return `application/zip`
+	case FormatTarZst:
+		return `application/zstd`
+	}
+
+	return `application/octet-stream`
+}
+
+// archiveBase is the name of the blob holding a release of project, without its extension
+func archiveBase(project, release string) string {
+	if release == `` || release == DefaultRelease {
+		return project
+	}
+
+	return releasesFolder + `/` + project + `/` + release
+}
+
+// ArchiveNames returns every blob name that could hold the given release of a project, in the order we look for them.
+// The default release lives at <project>.<ext>, named releases at releases/<project>/<release>.<ext>.
+// A release that isn't a release name, from config or the active release blob, has none.
+func ArchiveNames(project, release string) []string {
+	if release != `` && release != DefaultRelease && !ValidReleaseName(release) {
+		return nil
+	}
+	base := archiveBase(project, release)
+	rtn := make([]string, 0, len(archiveExtensions))
+	for _, ae := range archiveExtensions {
+		rtn = append(rtn, base+ae.extension)
+	}
+
+	return rtn
+}
+
+// blobPath escapes a blob name for the blob SDK, which puts it in the request URL as it is and cleans it as a path:
+// unescaped, a ? or # in a name would end the path, and a % would be decoded by the container
+func blobPath(name string) string {
+	segments := strings.Split(name, `/`)
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	return strings.Join(segments, `/`)
+}
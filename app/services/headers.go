@@ -0,0 +1,80 @@
+package services
+
+import (
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+// security headers
+const (
+	HeaderStrictTransportSecurity = `Strict-Transport-Security`
+	HeaderContentTypeOptions      = `X-Content-Type-Options`
+	HeaderFrameOptions            = `X-Frame-Options`
+	HeaderReferrerPolicy          = `Referrer-Policy`
+	HeaderPermissionsPolicy       = `Permissions-Policy`
+	HeaderCSP                     = `Content-Security-Policy`
+	HeaderCSPReportOnly           = `Content-Security-Policy-Report-Only`
+)
+
+// defaultSecurityHeaders is what every response gets unless config says otherwise.
+// There is no default content security policy: what a site needs depends too much on the site.
+var defaultSecurityHeaders = cfg.SecurityHeaderSettings{
+	StrictTransportSecurity: `max-age=31536000; includeSubDomains`,
+	ContentTypeOptions:      `nosniff`,
+	FrameOptions:            `SAMEORIGIN`,
+	ReferrerPolicy:          `strict-origin-when-cross-origin`,
+	PermissionsPolicy:       `camera=(), microphone=(), geolocation=(), payment=(), usb=()`,
+}
+
+// SecurityHeaders returns the security headers for responses from project, or for our own endpoints if project is empty:
+// the defaults, overridden by the SecurityHeaders settings and then by the project's own.
+func SecurityHeaders(project string) map[string]string {
+	settings := defaultSecurityHeaders
+	if cfg.Config != nil {
+		overrideSecurityHeaders(&settings, &cfg.Config.SecurityHeaders)
+		if project != `` {
+			overrideSecurityHeaders(&settings, cfg.Config.ForProject(project).SecurityHeaders)
+		}
+	}
+
+	cspHeader := HeaderCSP
+	if settings.CSPReportOnly != nil && *settings.CSPReportOnly {
+		cspHeader = HeaderCSPReportOnly
+	}
+	rtn := map[string]string{}
+	for header, value := range map[string]string{
+		HeaderStrictTransportSecurity: settings.StrictTransportSecurity,
+		HeaderContentTypeOptions:      settings.ContentTypeOptions,
+		HeaderFrameOptions:            settings.FrameOptions,
+		HeaderReferrerPolicy:          settings.ReferrerPolicy,
+		HeaderPermissionsPolicy:       settings.PermissionsPolicy,
+		cspHeader:                     settings.ContentSecurityPolicy,
+	} {
+		if value != `` && value != cfg.SecurityHeaderOff {
+			rtn[header] = value
+		}
+	}
+
+	return rtn
+}
+
+// overrideSecurityHeaders replaces the settings in to with those that are set in from
+func overrideSecurityHeaders(to, from *cfg.SecurityHeaderSettings) {
+	if from == nil {
+		return
+	}
+	for _, field := range []struct{ to, from *string }{
+		{&to.StrictTransportSecurity, &from.StrictTransportSecurity},
+		{&to.ContentTypeOptions, &from.ContentTypeOptions},
+		{&to.FrameOptions, &from.FrameOptions},
+		{&to.ReferrerPolicy, &from.ReferrerPolicy},
+		{&to.PermissionsPolicy, &from.PermissionsPolicy},
+		{&to.ContentSecurityPolicy, &from.ContentSecurityPolicy},
+	} {
+		if *field.from != `` {
+			*field.to = *field.from
+		}
+	}
+	if from.CSPReportOnly != nil {
+		to.CSPReportOnly = from.CSPReportOnly
+	}
+}
@@ -0,0 +1,45 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	defer func() { cfg.Config = nil }()
+	reportOnly, enforce := true, false
+	cfg.Config = &cfg.AppConfig{
+		SecurityHeaders: cfg.SecurityHeaderSettings{
+			ContentSecurityPolicy: `default-src 'self'`,
+			CSPReportOnly:         &reportOnly,
+		},
+		Projects: map[string]cfg.ProjectSettings{
+			`widgets`: {SecurityHeaders: &cfg.SecurityHeaderSettings{FrameOptions: cfg.SecurityHeaderOff, CSPReportOnly: &enforce}},
+		},
+	}
+
+	headers := SecurityHeaders(``)
+	if headers[HeaderContentTypeOptions] != `nosniff` || headers[HeaderFrameOptions] != `SAMEORIGIN` || headers[HeaderStrictTransportSecurity] == `` {
+		t.Errorf(`defaults missing: %v`, headers)
+	}
+	if headers[HeaderCSPReportOnly] != `default-src 'self'` || headers[HeaderCSP] != `` {
+		t.Errorf(`policy should only be reported: %v`, headers)
+	}
+
+	headers = SecurityHeaders(`widgets`)
+	if _, found := headers[HeaderFrameOptions]; found {
+		t.Errorf(`frame options should be off for a project that is framed elsewhere: %v`, headers)
+	}
+	if headers[HeaderCSP] != `default-src 'self'` || headers[HeaderCSPReportOnly] != `` {
+		t.Errorf(`project should enforce the policy: %v`, headers)
+	}
+	if headers[HeaderReferrerPolicy] != `strict-origin-when-cross-origin` {
+		t.Errorf(`project should keep the headers it doesn't override: %v`, headers)
+	}
+
+	cfg.Config = nil
+	if headers := SecurityHeaders(`docs`); len(headers) != 5 {
+		t.Errorf(`without config every default but a policy should be sent: %v`, headers)
+	}
+}
@@ -0,0 +1,208 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	enum "github.com/elephant-insurance/enumerations/v2"
+	"github.com/elephant-insurance/go-microservice-arch/v2/clicker"
+	"github.com/elephant-insurance/go-microservice-arch/v2/log"
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+	"github.com/elephant-insurance/go-microservice-arch/v2/uf"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+// default extraction limits, used when the config doesn't set them
+const (
+	defaultMaxCompressedBytes   = 256 << 20
+	defaultMaxUncompressedBytes = 1 << 30
+	defaultMaxEntries           = 20000
+	defaultMaxFileBytes         = 64 << 20
+	defaultMaxCompressionRatio  = 100
+	defaultSpillBytes           = 1 << 20
+	// archives smaller than this are never rejected for their compression ratio
+	minRatioCheckBytes = 1 << 20
+	// we only keep this many breaches waiting for the alert analytics to pick them up
+	maxPendingLimitEvents = 100
+
+	LimitCompressedBytes   = `compressed size`
+	LimitUncompressedBytes = `total uncompressed size`
+	LimitEntries           = `entry count`
+	LimitFileBytes         = `file size`
+	LimitCompressionRatio  = `compression ratio`
+)
+
+var (
+	// LimitBreaches counts the archives we have refused to finish extracting
+	LimitBreaches *clicker.Clicker = &clicker.Clicker{}
+
+	pendingLimitEvents     []*uf.Event
+	pendingLimitEventsLock sync.Mutex
+)
+
+// LimitError is returned when an archive goes over one of the extraction limits
+type LimitError struct {
+	Limit string `json:"limit"`
+	Value int64  `json:"value"`
+	Max   int64  `json:"max"`
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf(`archive exceeds the %v limit (%v > %v)`, e.Limit, e.Value, e.Max)
+}
+
+// extractionLimits holds the limits in force for a single extraction
+type extractionLimits struct {
+	compressedBytes   int64
+	uncompressedBytes int64
+	entries           int64
+	fileBytes         int64
+	compressionRatio  int64
+	// files bigger than spillBytes are kept on disk under spillDir instead of in memory
+	spillBytes int64
+	spillDir   string
+}
+
+func currentLimits() extractionLimits {
+	rtn := extractionLimits{
+		compressedBytes:   defaultMaxCompressedBytes,
+		uncompressedBytes: defaultMaxUncompressedBytes,
+		entries:           defaultMaxEntries,
+		fileBytes:         defaultMaxFileBytes,
+		compressionRatio:  defaultMaxCompressionRatio,
+		spillBytes:        defaultSpillBytes,
+		spillDir:          os.TempDir(),
+	}
+	if cfg.Config == nil {
+		return rtn
+	}
+
+	s := cfg.Config.Extraction
+	if s.MaxCompressedBytes != nil && *s.MaxCompressedBytes > 0 {
+		rtn.compressedBytes = int64(*s.MaxCompressedBytes)
+	}
+	if s.MaxUncompressedBytes != nil && *s.MaxUncompressedBytes > 0 {
+		rtn.uncompressedBytes = int64(*s.MaxUncompressedBytes)
+	}
+	if s.MaxEntries != nil && *s.MaxEntries > 0 {
+		rtn.entries = int64(*s.MaxEntries)
+	}
+	if s.MaxFileBytes != nil && *s.MaxFileBytes > 0 {
+		rtn.fileBytes = int64(*s.MaxFileBytes)
+	}
+	if s.MaxCompressionRatio != nil && *s.MaxCompressionRatio > 0 {
+		rtn.compressionRatio = int64(*s.MaxCompressionRatio)
+	}
+	if s.SpillBytes != nil && *s.SpillBytes >= 0 {
+		rtn.spillBytes = int64(*s.SpillBytes)
+	}
+	if s.SpillDir != `` {
+		rtn.spillDir = s.SpillDir
+	}
+
+	return rtn
+}
+
+// MaxCompressedBytes is the largest archive we will download or accept for publishing
+func MaxCompressedBytes() int64 {
+	return currentLimits().compressedBytes
+}
+
+// limitTracker enforces the extraction limits as we stream through an archive
+type limitTracker struct {
+	limits       extractionLimits
+	compressed   *countingReader
+	uncompressed int64
+	entries      int64
+}
+
+func newLimitTracker(archive io.Reader) *limitTracker {
+	lt := &limitTracker{limits: currentLimits()}
+	lt.compressed = &countingReader{r: archive, max: lt.limits.compressedBytes}
+
+	return lt
+}
+
+// addEntry counts one more entry in the archive
+func (lt *limitTracker) addEntry() error {
+	lt.entries++
+	if lt.entries > lt.limits.entries {
+		return &LimitError{Limit: LimitEntries, Value: lt.entries, Max: lt.limits.entries}
+	}
+
+	return nil
+}
+
+// addFileBytes counts size more bytes of file content, read from one file so far
+func (lt *limitTracker) addFileBytes(size int64) error {
+	if size > lt.limits.fileBytes {
+		return &LimitError{Limit: LimitFileBytes, Value: size, Max: lt.limits.fileBytes}
+	}
+
+	lt.uncompressed += size
+	if lt.uncompressed > lt.limits.uncompressedBytes {
+		return &LimitError{Limit: LimitUncompressedBytes, Value: lt.uncompressed, Max: lt.limits.uncompressedBytes}
+	}
+
+	if lt.uncompressed > minRatioCheckBytes && lt.compressed.count > 0 {
+		if ratio := lt.uncompressed / lt.compressed.count; ratio > lt.limits.compressionRatio {
+			return &LimitError{Limit: LimitCompressionRatio, Value: ratio, Max: lt.limits.compressionRatio}
+		}
+	}
+
+	return nil
+}
+
+// countingReader counts the bytes read through it and fails once they pass max
+type countingReader struct {
+	r     io.Reader
+	count int64
+	max   int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	// never read more than one byte past the limit, and never hand on the bytes of a read that crosses it
+	remaining := cr.max - cr.count + 1
+	if remaining <= 0 {
+		return 0, &LimitError{Limit: LimitCompressedBytes, Value: cr.count, Max: cr.max}
+	}
+	if int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := cr.r.Read(p)
+	cr.count += int64(n)
+	if cr.count > cr.max {
+		return 0, &LimitError{Limit: LimitCompressedBytes, Value: cr.count, Max: cr.max}
+	}
+
+	return n, err
+}
+
+// recordLimitBreach counts a breach, logs it as an event, and queues it for the diagnostics alerts
+func recordLimitBreach(c msrqc.Context, project string, le *LimitError) {
+	LimitBreaches.Click(1)
+
+	msg := fmt.Sprintf(`archive for project %v rejected: %v`, project, le.Error())
+	evt := uf.EventFactory.New(&enum.Event.ServiceRequestInvalid.ID, nil, msg)
+	evt.OverrideSeverity(&enum.EventSeverity.Error.ID)
+	log.ForFunc(c).SetName(project).WithEvent(evt).Error(msg)
+
+	pendingLimitEventsLock.Lock()
+	defer pendingLimitEventsLock.Unlock()
+	if len(pendingLimitEvents) < maxPendingLimitEvents {
+		pendingLimitEvents = append(pendingLimitEvents, evt)
+	}
+}
+
+// LimitAlerts is an alert.AnalyticFunction that reports the limit breaches since it last ran
+func LimitAlerts() []*uf.Event {
+	pendingLimitEventsLock.Lock()
+	defer pendingLimitEventsLock.Unlock()
+
+	rtn := pendingLimitEvents
+	pendingLimitEvents = nil
+
+	return rtn
+}
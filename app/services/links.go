@@ -0,0 +1,119 @@
+package services
+
+import (
+	"path"
+	"strings"
+)
+
+// archiveLink is a symlink or hard link found in an archive
+type archiveLink struct {
+	// name is the normalized path of the link
+	name string
+	// raw is the name of the link as the archive gives it, for reporting
+	raw string
+	// target is the normalized path the link points at
+	target string
+}
+
+// linkTarget works out the normalized path an archive link points at.
+// Symlinks are relative to the folder holding them, hard links to the archive root.
+// It returns a problem instead if the target is outside the archive.
+func linkTarget(name string, entry *archiveEntry) (string, string) {
+	target := strings.ReplaceAll(entry.linkTarget, `\`, `/`)
+	if target == `` {
+		return ``, `link has no target`
+	}
+	if entry.kind == entryHardLink {
+		normalized, problem := normalizeEntryName(target)
+		if problem != `` {
+			return ``, `link escapes the site root`
+		}
+		return normalized, ``
+	}
+
+	if strings.HasPrefix(target, `/`) || path.IsAbs(target) || (len(target) > 1 && target[1] == ':') {
+		return ``, `link escapes the site root`
+	}
+	resolved := path.Join(path.Dir(name), target)
+	if resolved == `..` || strings.HasPrefix(resolved, `../`) {
+		return ``, `link escapes the site root`
+	}
+
+	return resolved, ``
+}
+
+// resolveLinks copies the files each link points at to the link's own path, so that links are served like the files they point at.
+// A link to a folder gets a copy of everything in it, once any links inside that folder are resolved.
+// Links are resolved in as many passes as it takes, so that links to links work;
+// the ones left over point at nothing in the archive, or at each other.
+func resolveLinks(files map[string]*snapshotFile, links []archiveLink, limits *limitTracker) (int, []archiveLink, error) {
+	resolved := 0
+	pending := links
+	for progress := true; progress && len(pending) > 0; {
+		progress = false
+		var unresolved []archiveLink
+		for _, l := range pending {
+			if f, found := files[l.target]; found {
+				if err := limits.addEntry(); err != nil {
+					return resolved, nil, err
+				}
+				files[l.name] = f
+				resolved++
+				progress = true
+				continue
+			}
+
+			prefix := l.target + `/`
+			if l.target == `.` {
+				prefix = ``
+			}
+			if !hasFilesUnder(files, prefix) || hasLinksUnder(pending, prefix) {
+				unresolved = append(unresolved, l)
+				continue
+			}
+			for name, f := range filesUnder(files, prefix) {
+				if err := limits.addEntry(); err != nil {
+					return resolved, nil, err
+				}
+				files[l.name+`/`+strings.TrimPrefix(name, prefix)] = f
+			}
+			resolved++
+			progress = true
+		}
+		pending = unresolved
+	}
+
+	return resolved, pending, nil
+}
+
+func hasFilesUnder(files map[string]*snapshotFile, prefix string) bool {
+	for name := range files {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasLinksUnder(links []archiveLink, prefix string) bool {
+	for _, l := range links {
+		if strings.HasPrefix(l.name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filesUnder returns the files under prefix, copied out so that the caller can add to files while ranging over them
+func filesUnder(files map[string]*snapshotFile, prefix string) map[string]*snapshotFile {
+	rtn := map[string]*snapshotFile{}
+	for name, f := range files {
+		if strings.HasPrefix(name, prefix) {
+			rtn[name] = f
+		}
+	}
+
+	return rtn
+}
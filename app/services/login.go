@@ -0,0 +1,394 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/log"
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+	"github.com/elephant-insurance/go-microservice-arch/v2/sec"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+	jwtverifier "github.com/okta/okta-jwt-verifier-golang"
+)
+
+const (
+	// SessionCookieName holds the encrypted session of a signed-in browser
+	SessionCookieName = `ms-sites-session`
+	// LoginCookieName holds the encrypted state of a login in progress
+	LoginCookieName = `ms-sites-login`
+	// LoginFlowSeconds is how long a browser has to come back from the identity provider
+	LoginFlowSeconds = 10 * 60
+
+	defaultSessionMinutes = 8 * 60
+	defaultLoginScopes    = `openid,profile,email`
+	defaultRolesClaim     = `groups`
+	providerTimeout       = 10 * time.Second
+)
+
+// ErrLoginFailed is returned when a browser comes back from the identity provider without a login we can trust
+var ErrLoginFailed = errors.New(`login failed`)
+
+// Session is who a browser has signed in as
+type Session struct {
+	Subject string   `json:"sub"`
+	Name    string   `json:"name,omitempty"`
+	Email   string   `json:"email,omitempty"`
+	Roles   []string `json:"roles,omitempty"`
+	Expires int64    `json:"exp"`
+}
+
+// AccessToken describes the session the way sec describes a bearer token, so that the same role checks apply to both
+func (s *Session) AccessToken() sec.AccessToken {
+	expires := s.Expires
+	return sec.AccessToken{
+		Subject:  s.Subject,
+		UserID:   s.Subject,
+		UserName: s.Name,
+		Email:    s.Email,
+		Scope:    s.Roles,
+		ExpTime:  &expires,
+	}
+}
+
+// loginFlow is what we remember between sending a browser to the identity provider and it coming back
+type loginFlow struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Return   string `json:"return"`
+	Expires  int64  `json:"exp"`
+}
+
+// providerMetadata is the part of the identity provider's discovery document we use
+type providerMetadata struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+var (
+	provider     *providerMetadata
+	providerLock sync.Mutex
+	loginClient  = &http.Client{Timeout: providerTimeout}
+)
+
+// loginProvider returns the identity provider's endpoints, fetching them the first time they are needed.
+// A failed fetch is tried again next time rather than remembered.
+func loginProvider() (*providerMetadata, error) {
+	providerLock.Lock()
+	defer providerLock.Unlock()
+	if provider != nil {
+		return provider, nil
+	}
+
+	resp, err := loginClient.Get(strings.TrimSuffix(cfg.Config.Login.Issuer, `/`) + `/.well-known/openid-configuration`)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(`identity provider discovery returned %v`, resp.Status)
+	}
+	pm := &providerMetadata{}
+	if err := json.NewDecoder(resp.Body).Decode(pm); err != nil {
+		return nil, err
+	}
+	if pm.AuthorizationEndpoint == `` || pm.TokenEndpoint == `` {
+		return nil, errors.New(`identity provider discovery has no authorization or token endpoint`)
+	}
+	provider = pm
+
+	return provider, nil
+}
+
+// StartLogin returns where to send the browser to sign in, and the sealed login state to keep in its cookie until it comes back.
+// The browser is sent back to returnTo afterwards.
+func StartLogin(returnTo string) (string, string, error) {
+	pm, err := loginProvider()
+	if err != nil {
+		return ``, ``, err
+	}
+
+	flow := loginFlow{Return: SafeReturn(returnTo), Expires: time.Now().Add(LoginFlowSeconds * time.Second).Unix()}
+	for _, field := range []*string{&flow.State, &flow.Nonce, &flow.Verifier} {
+		if *field, err = randomString(32); err != nil {
+			return ``, ``, err
+		}
+	}
+	sealed, err := seal(LoginCookieName, flow)
+	if err != nil {
+		return ``, ``, err
+	}
+
+	challenge := sha256.Sum256([]byte(flow.Verifier))
+	q := url.Values{
+		`response_type`:         {`code`},
+		`client_id`:             {cfg.Config.Login.ClientID},
+		`redirect_uri`:          {cfg.Config.Login.RedirectURL},
+		`scope`:                 {strings.Join(loginScopes(), ` `)},
+		`state`:                 {flow.State},
+		`nonce`:                 {flow.Nonce},
+		`code_challenge`:        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		`code_challenge_method`: {`S256`},
+	}
+
+	return addQuery(pm.AuthorizationEndpoint, q), sealed, nil
+}
+
+// FinishLogin checks the browser's return from the identity provider against the login state in its cookie,
+// exchanges the code for tokens, and returns the new session and where to send the browser next.
+func FinishLogin(c msrqc.Context, sealedFlow, state, code string) (*Session, string, error) {
+	lw := log.ForFunc(c)
+	flow := loginFlow{}
+	if err := open(LoginCookieName, sealedFlow, &flow); err != nil || flow.Expires < time.Now().Unix() {
+		lw.WithError(err).Warn("login state missing or expired")
+		return nil, ``, ErrLoginFailed
+	}
+	if state == `` || code == `` || !constantTimeEqual(state, flow.State) {
+		lw.Warn("login state doesn't match")
+		return nil, ``, ErrLoginFailed
+	}
+
+	idToken, err := exchangeCode(c, code, flow.Verifier)
+	if err != nil {
+		lw.WithError(err).Error("error exchanging login code")
+		return nil, ``, ErrLoginFailed
+	}
+	jv := jwtverifier.JwtVerifier{
+		Issuer:           cfg.Config.Login.Issuer,
+		ClaimsToValidate: map[string]string{`aud`: cfg.Config.Login.ClientID, `nonce`: flow.Nonce},
+	}
+	token, err := jv.New().VerifyIdToken(idToken)
+	if err != nil {
+		lw.WithError(err).Warn("identity token rejected")
+		return nil, ``, ErrLoginFailed
+	}
+
+	session := sessionFromClaims(token.Claims)
+	if session.Subject == `` {
+		return nil, ``, ErrLoginFailed
+	}
+
+	return session, flow.Return, nil
+}
+
+// exchangeCode swaps an authorization code, and the PKCE verifier that goes with it, for an identity token
+func exchangeCode(c msrqc.Context, code, verifier string) (string, error) {
+	pm, err := loginProvider()
+	if err != nil {
+		return ``, err
+	}
+
+	form := url.Values{
+		`grant_type`:    {`authorization_code`},
+		`code`:          {code},
+		`redirect_uri`:  {cfg.Config.Login.RedirectURL},
+		`client_id`:     {cfg.Config.Login.ClientID},
+		`code_verifier`: {verifier},
+	}
+	if cfg.Config.Login.ClientSecret != `` {
+		form.Set(`client_secret`, cfg.Config.Login.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(c, http.MethodPost, pm.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return ``, err
+	}
+	req.Header.Set(`Content-Type`, `application/x-www-form-urlencoded`)
+	req.Header.Set(`Accept`, `application/json`)
+
+	resp, err := loginClient.Do(req)
+	if err != nil {
+		return ``, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return ``, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ``, fmt.Errorf(`token endpoint returned %v: %s`, resp.Status, body)
+	}
+	tokens := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return ``, err
+	}
+	if tokens.IDToken == `` {
+		return ``, errors.New(`token endpoint returned no id_token`)
+	}
+
+	return tokens.IDToken, nil
+}
+
+// sessionFromClaims builds a session from the claims of an identity token
+func sessionFromClaims(claims map[string]interface{}) *Session {
+	minutes := defaultSessionMinutes
+	if m := cfg.Config.Login.SessionMinutes; m != nil && *m > 0 {
+		minutes = *m
+	}
+	s := &Session{Expires: time.Now().Add(time.Duration(minutes) * time.Minute).Unix()}
+	s.Subject, _ = claims[`sub`].(string)
+	s.Email, _ = claims[`email`].(string)
+	if s.Name, _ = claims[`name`].(string); s.Name == `` {
+		s.Name, _ = claims[`preferred_username`].(string)
+	}
+
+	rolesClaim := cfg.Config.Login.RolesClaim
+	if rolesClaim == `` {
+		rolesClaim = defaultRolesClaim
+	}
+	switch roles := claims[rolesClaim].(type) {
+	case string:
+		s.Roles = strings.Fields(roles)
+	case []interface{}:
+		for _, role := range roles {
+			if r, ok := role.(string); ok {
+				s.Roles = append(s.Roles, r)
+			}
+		}
+	}
+
+	return s
+}
+
+// SealSession encrypts a session for its cookie
+func SealSession(s *Session) (string, error) {
+	return seal(SessionCookieName, s)
+}
+
+// OpenSession decrypts a session cookie, returning nil if it isn't one of ours or has expired
+func OpenSession(value string) *Session {
+	if value == `` || !cfg.Config.LoginEnabled() {
+		return nil
+	}
+	s := &Session{}
+	if err := open(SessionCookieName, value, s); err != nil || s.Expires < time.Now().Unix() {
+		return nil
+	}
+
+	return s
+}
+
+// LogoutURL is where to send a browser that has signed out: the identity provider's logout page if it has one, or returnTo
+func LogoutURL(returnTo string) string {
+	returnTo = SafeReturn(returnTo)
+	pm, err := loginProvider()
+	if err != nil || pm.EndSessionEndpoint == `` {
+		return returnTo
+	}
+
+	return addQuery(pm.EndSessionEndpoint, url.Values{`client_id`: {cfg.Config.Login.ClientID}})
+}
+
+// SafeReturn keeps returnTo if it is a path on this site, so that the login flow can't be used to send people elsewhere
+func SafeReturn(returnTo string) string {
+	if !strings.HasPrefix(returnTo, `/`) || strings.HasPrefix(returnTo, `//`) || strings.HasPrefix(returnTo, `/\`) {
+		return `/`
+	}
+
+	return returnTo
+}
+
+// SecureCookies reports whether our cookies should only go over HTTPS, which they should whenever we are reached over it
+func SecureCookies() bool {
+	return strings.HasPrefix(cfg.Config.Login.RedirectURL, `https://`)
+}
+
+func loginScopes() []string {
+	scopes := cfg.Config.Login.Scopes
+	if scopes == `` {
+		scopes = defaultLoginScopes
+	}
+	rtn := []string{}
+	for _, scope := range strings.Split(scopes, `,`) {
+		if scope = strings.TrimSpace(scope); scope != `` {
+			rtn = append(rtn, scope)
+		}
+	}
+
+	return rtn
+}
+
+func addQuery(endpoint string, q url.Values) string {
+	if strings.Contains(endpoint, `?`) {
+		return endpoint + `&` + q.Encode()
+	}
+
+	return endpoint + `?` + q.Encode()
+}
+
+// seal encrypts v with the session key. The purpose, the cookie name, is bound in, so that one cookie can't stand in for another.
+func seal(purpose string, v interface{}) (string, error) {
+	gcm, err := sessionCipher()
+	if err != nil {
+		return ``, err
+	}
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return ``, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return ``, err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(gcm.Seal(nonce, nonce, plain, []byte(purpose))), nil
+}
+
+// open decrypts what seal encrypted into v
+func open(purpose, sealed string, v interface{}) error {
+	gcm, err := sessionCipher()
+	if err != nil {
+		return err
+	}
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return err
+	}
+	if len(data) < gcm.NonceSize() {
+		return errors.New(`sealed value too short`)
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(purpose))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(plain, v)
+}
+
+func sessionCipher() (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(cfg.Config.Login.SessionKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return ``, err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
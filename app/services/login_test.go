@@ -0,0 +1,152 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+// stubIdP is just enough of an OpenID Connect provider to log in against
+type stubIdP struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	nonce     string
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &stubIdP{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/.well-known/openid-configuration`, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			`issuer`:                 idp.URL,
+			`authorization_endpoint`: idp.URL + `/authorize`,
+			`token_endpoint`:         idp.URL + `/token`,
+			`end_session_endpoint`:   idp.URL + `/logout`,
+			`jwks_uri`:               idp.URL + `/keys`,
+		})
+	})
+	mux.HandleFunc(`/keys`, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{`keys`: []map[string]string{{
+			`kty`: `RSA`, `kid`: `stub`, `use`: `sig`, `alg`: `RS256`,
+			`n`: base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			`e`: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc(`/token`, func(w http.ResponseWriter, r *http.Request) {
+		verifier := sha256.Sum256([]byte(r.PostFormValue(`code_verifier`)))
+		if r.PostFormValue(`code`) != `good-code` || base64.RawURLEncoding.EncodeToString(verifier[:]) != idp.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{`id_token`: idp.sign(t, map[string]interface{}{
+			`iss`: idp.URL, `aud`: `ms-sites`, `sub`: `jdoe`, `name`: `Jane Doe`, `email`: `jdoe@example.com`,
+			`groups`: []string{`docs-readers`}, `nonce`: idp.nonce,
+			`iat`: time.Now().Unix(), `exp`: time.Now().Add(time.Hour).Unix(),
+		})})
+	})
+	idp.Server = httptest.NewServer(mux)
+
+	return idp
+}
+
+func (idp *stubIdP) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{`alg`: `RS256`, `kid`: `stub`, `typ`: `JWT`})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + `.` + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + `.` + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestLogin(t *testing.T) {
+	c := msrqc.New(context.Background())
+	idp := newStubIdP(t)
+	defer idp.Close()
+	defer func() { cfg.Config, provider = nil, nil }()
+	cfg.Config = &cfg.AppConfig{Login: cfg.LoginSettings{
+		Issuer: idp.URL, ClientID: `ms-sites`, RedirectURL: `http://localhost:4000/auth/callback`,
+		SessionKey: `0123456789abcdef0123456789abcdef`,
+	}}
+
+	authURL, flow, err := StartLogin(`/docs/guide/`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(authURL)
+	q := u.Query()
+	if u.Path != `/authorize` || q.Get(`code_challenge_method`) != `S256` || q.Get(`client_id`) != `ms-sites` {
+		t.Fatalf(`bad authorization URL %v`, authURL)
+	}
+	idp.challenge, idp.nonce = q.Get(`code_challenge`), q.Get(`nonce`)
+
+	if _, _, err := FinishLogin(c, flow, `forged`, `good-code`); err != ErrLoginFailed {
+		t.Errorf(`login with the wrong state should fail, got %v`, err)
+	}
+	if _, _, err := FinishLogin(c, flow, q.Get(`state`), `bad-code`); err != ErrLoginFailed {
+		t.Errorf(`login with a bad code should fail, got %v`, err)
+	}
+	session, returnTo, err := FinishLogin(c, flow, q.Get(`state`), `good-code`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if returnTo != `/docs/guide/` || session.Subject != `jdoe` || session.Name != `Jane Doe` || len(session.Roles) != 1 || session.Roles[0] != `docs-readers` {
+		t.Errorf(`wrong session %+v, returning to %v`, session, returnTo)
+	}
+
+	sealed, err := SealSession(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened := OpenSession(sealed); opened == nil || opened.AccessToken().Subject != `jdoe` {
+		t.Errorf(`session didn't survive its cookie: %+v`, opened)
+	}
+	if OpenSession(flow) != nil {
+		t.Error(`login state accepted as a session`)
+	}
+	if LogoutURL(`/docs/`) != idp.URL+`/logout?client_id=ms-sites` {
+		t.Errorf(`wrong logout URL %v`, LogoutURL(`/docs/`))
+	}
+
+	cfg.Config.Login.SessionKey = `fedcba9876543210fedcba9876543210`
+	if OpenSession(sealed) != nil {
+		t.Error(`session accepted after the key changed`)
+	}
+}
+
+func TestSafeReturn(t *testing.T) {
+	tests := map[string]string{
+		`/docs/guide/?page=2`: `/docs/guide/?page=2`,
+		``:                    `/`,
+		`https://evil.com/`:   `/`,
+		`//evil.com/`:         `/`,
+		`/\evil.com/`:         `/`,
+		`docs`:                `/`,
+	}
+	for given, expected := range tests {
+		if actual := SafeReturn(given); actual != expected {
+			t.Errorf(`SafeReturn(%q) = %q, expected %q`, given, actual, expected)
+		}
+	}
+}
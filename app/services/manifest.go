@@ -0,0 +1,75 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+// SiteManifestName is the file at the root of a site archive that says how the site should be served.
+// It is read when the archive is extracted, and never served itself.
+const SiteManifestName = `.ms-sites.json`
+
+// SiteManifest is what a site can say about itself. Project settings in config override it.
+type SiteManifest struct {
+	// Access is who may see the site, one of the cfg access policies that the security settings can check
+	Access string `json:"access,omitempty"`
+	// Roles maps path patterns within the site to the agent roles that may see them
+	Roles map[string][]string `json:"roles,omitempty"`
+	// BasicAuth maps the users of a site with basic access to bcrypt hashes of their passwords
+	BasicAuth map[string]string `json:"basicAuth,omitempty"`
+	// AllowedIPs are the client addresses or CIDR ranges that may see the site at all
+	AllowedIPs []string `json:"allowedIPs,omitempty"`
+	// CORS is which other origins may use the site's documents
+	CORS *cfg.CORSPolicy `json:"cors,omitempty"`
+}
+
+// readSiteManifest takes the site manifest out of the files of snap, if there is one, and checks it
+func (s *Snapshot) readSiteManifest(report *ArchiveReport) {
+	docPath := s.Project + `/` + SiteManifestName
+	r, _, err := s.Open(docPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	delete(s.files, docPath)
+	if err != nil {
+		report.addProblem(SiteManifestName, `can't read site manifest: %v`, err)
+		return
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err == nil {
+		err = json.Unmarshal(data, &s.Manifest)
+	}
+	if err != nil {
+		report.addProblem(SiteManifestName, `invalid site manifest: %v`, err)
+		return
+	}
+	if s.Manifest.Access != `` {
+		// held to the same rules as config, so that a site can't ask for a check this replica can't make
+		if err := cfg.Config.CheckAccess(s.Manifest.Access); err != nil {
+			report.addProblem(SiteManifestName, `unsupported access policy %q: %v`, s.Manifest.Access, err)
+		}
+	}
+	for user, hash := range s.Manifest.BasicAuth {
+		if err := cfg.CheckBasicAuthUser(user, hash); err != nil {
+			report.addProblem(SiteManifestName, `invalid basic auth: %v`, err)
+		}
+	}
+	for _, entry := range s.Manifest.AllowedIPs {
+		if _, err := cfg.ParseIPRange(entry); err != nil {
+			report.addProblem(SiteManifestName, `invalid allowed IPs: %v`, err)
+		}
+	}
+	if err := cfg.CheckCORSPolicy(s.Manifest.CORS); err != nil {
+		report.addProblem(SiteManifestName, `invalid CORS policy: %v`, err)
+	}
+	for pattern, roles := range s.Manifest.Roles {
+		if err := cfg.CheckRoleRule(pattern, roles); err != nil {
+			report.addProblem(SiteManifestName, `invalid roles: %v`, err)
+		}
+	}
+}
@@ -1,20 +1,57 @@
 package services
 
+import "mime"
+
 func DetectMimeType(fileType string) string {
 	switch fileType {
-	case `js`:
+	case `js`, `mjs`:
 		return `text/javascript`
 
 	case `css`:
 		return `text/css`
 
-	case `html`:
+	case `html`, `htm`:
 		return `text/html`
 
 	case `ico`:
 		return `image/vnd.microsoft.icon`
 
+	case `svg`:
+		return `image/svg+xml`
+
+	case `png`:
+		return `image/png`
+
+	case `jpg`, `jpeg`:
+		return `image/jpeg`
+
+	case `gif`:
+		return `image/gif`
+
+	case `webp`:
+		return `image/webp`
+
+	case `json`, `map`:
+		return `application/json`
+
+	case `woff`:
+		return `font/woff`
+
+	case `woff2`:
+		return `font/woff2`
+
+	case `pdf`:
+		return `application/pdf`
+
+	case `xml`:
+		return `application/xml`
+
 	default:
+		if fileType != `` {
+			if byExtension := mime.TypeByExtension(`.` + fileType); byExtension != `` {
+				return byExtension
+			}
+		}
 		return "text/plain"
 	}
 }
@@ -0,0 +1,220 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/clicker"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+	goCache "github.com/patrickmn/go-cache"
+)
+
+const (
+	defaultNotFoundSeconds         = 60
+	defaultNotFoundMaxEntries      = 10000
+	defaultUnknownLookupsPerMinute = 120
+)
+
+var (
+	// ErrNotFound is returned when we already know that what was asked for isn't in the container
+	ErrNotFound = errors.New(`not found in the container`)
+	// ErrLookupThrottled is returned when too many projects we have never seen are being looked up, as scanners do
+	ErrLookupThrottled = errors.New(`too many lookups of unknown projects`)
+
+	// missing remembers the cache keys that weren't in the container, so that we don't ask again every time
+	missing = goCache.New(defaultNotFoundSeconds*time.Second, cachePurgeSeconds*time.Second)
+	// foundProjects remembers the projects we have found in the container, which are never throttled
+	foundProjects  = goCache.New(cacheRetentionSeconds*time.Second, cachePurgeSeconds*time.Second)
+	unknownLookups = &lookupBudget{}
+	// missBudgets holds a lookupBudget for each blob mode project, spent by lookups of its files that find nothing
+	missBudgets = goCache.New(cacheRetentionSeconds*time.Second, cachePurgeSeconds*time.Second)
+
+	NotFoundHits     *clicker.Clicker = &clicker.Clicker{}
+	ThrottledLookups *clicker.Clicker = &clicker.Clicker{}
+)
+
+// notFoundSettings returns the configured TTL, size cap and unknown lookup rate, or their defaults
+func notFoundSettings() (ttl time.Duration, maxEntries, perMinute int) {
+	ttl, maxEntries, perMinute = defaultNotFoundSeconds*time.Second, defaultNotFoundMaxEntries, defaultUnknownLookupsPerMinute
+	if cfg.Config == nil {
+		return
+	}
+	nf := cfg.Config.NotFound
+	if nf.Seconds != nil && *nf.Seconds >= 0 {
+		ttl = time.Duration(*nf.Seconds) * time.Second
+	}
+	if nf.MaxEntries != nil && *nf.MaxEntries >= 0 {
+		maxEntries = *nf.MaxEntries
+	}
+	if nf.UnknownLookupsPerMinute != nil && *nf.UnknownLookupsPerMinute >= 0 {
+		perMinute = *nf.UnknownLookupsPerMinute
+	}
+
+	return
+}
+
+// knownMissing reports whether we recently found key missing from the container
+func knownMissing(key string) bool {
+	if _, found := missing.Get(key); found {
+		NotFoundHits.Click(1)
+		return true
+	}
+
+	return false
+}
+
+// rememberMissing notes that key isn't in the container, unless negative caching is off or the cache is full.
+// The cap stops a scanner asking for random names from filling memory.
+func rememberMissing(key string) {
+	ttl, maxEntries, _ := notFoundSettings()
+	if ttl <= 0 {
+		return
+	}
+	if missing.ItemCount() >= maxEntries {
+		missing.DeleteExpired()
+		if missing.ItemCount() >= maxEntries {
+			return
+		}
+	}
+	missing.Set(key, true, ttl)
+}
+
+// rememberFound notes that project is in the container, and forgets any earlier miss for key
+func rememberFound(project, key string) {
+	missing.Delete(key)
+	foundProjects.Set(project, true, 0)
+}
+
+// allowLookup reports whether we may ask the container for project.
+// Projects that are configured, cached or have been found before always may;
+// others share a small budget, so that scanners trying random names can't run up our storage bill.
+func allowLookup(project string) bool {
+	if _, found := foundProjects.Get(project); found {
+		return true
+	}
+	if cfg.Config.HasProject(project) {
+		return true
+	}
+	if len(CachedSnapshots(project)) > 0 {
+		return true
+	}
+
+	_, _, perMinute := notFoundSettings()
+	if perMinute == 0 || unknownLookups.take(perMinute) {
+		return true
+	}
+	ThrottledLookups.Click(1)
+
+	return false
+}
+
+// allowFileLookup reports whether we may ask the container for a file of blob mode project that we don't have.
+// Files that are there cost nothing, but every miss spends from the project's budget (see spendFileMiss),
+// so that scanners trying random paths can't run up our storage bill either.
+func allowFileLookup(project string) bool {
+	_, _, perMinute := notFoundSettings()
+	if perMinute == 0 || fileMissBudget(project).available(perMinute) {
+		return true
+	}
+	ThrottledLookups.Click(1)
+
+	return false
+}
+
+// spendFileMiss notes that a lookup of a file of blob mode project found nothing
+func spendFileMiss(project string) {
+	if _, _, perMinute := notFoundSettings(); perMinute > 0 {
+		fileMissBudget(project).take(perMinute)
+	}
+}
+
+func fileMissBudget(project string) *lookupBudget {
+	if lb, found := missBudgets.Get(project); found {
+		return lb.(*lookupBudget)
+	}
+	lb := &lookupBudget{}
+	if err := missBudgets.Add(project, lb, 0); err != nil {
+		// somebody else added one first
+		if other, found := missBudgets.Get(project); found {
+			return other.(*lookupBudget)
+		}
+	}
+
+	return lb
+}
+
+// lookupBudget is a token bucket refilled at a rate per minute, holding at most a minute's worth
+type lookupBudget struct {
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+// take spends a token if there is one
+func (lb *lookupBudget) take(perMinute int) bool {
+	taken, _ := lb.takeOrWait(perMinute)
+
+	return taken
+}
+
+// available reports whether there is a token, without spending it
+func (lb *lookupBudget) available(perMinute int) bool {
+	lb.Lock()
+	defer lb.Unlock()
+
+	lb.refill(perMinute)
+
+	return lb.tokens >= 1
+}
+
+// takeOrWait spends a token if there is one, and otherwise says how long until there will be
+func (lb *lookupBudget) takeOrWait(perMinute int) (bool, time.Duration) {
+	lb.Lock()
+	defer lb.Unlock()
+
+	lb.refill(perMinute)
+	if lb.tokens < 1 {
+		return false, time.Duration((1 - lb.tokens) / float64(perMinute) * float64(time.Minute))
+	}
+	lb.tokens--
+
+	return true, 0
+}
+
+// refill adds the tokens earned since the last refill; the caller must hold the lock
+func (lb *lookupBudget) refill(perMinute int) {
+	rn := time.Now()
+	if lb.last.IsZero() {
+		lb.tokens = float64(perMinute)
+	} else {
+		lb.tokens += rn.Sub(lb.last).Minutes() * float64(perMinute)
+	}
+	if lb.tokens > float64(perMinute) {
+		lb.tokens = float64(perMinute)
+	}
+	lb.last = rn
+}
+
+// NotFoundDiagnostics reports on negative caching and throttled lookups
+func NotFoundDiagnostics() map[string]interface{} {
+	return map[string]interface{}{
+		`entries`:   missing.ItemCount(),
+		`hits`:      NotFoundHits.Clicks,
+		`throttled`: ThrottledLookups.Clicks,
+	}
+}
+
+// forgetMissing forgets every miss for project, or for all projects if project is empty
+func forgetMissing(project string) {
+	if project == `` {
+		missing.Flush()
+		return
+	}
+	for key := range missing.Items() {
+		if strings.HasPrefix(key, project+`@`) || strings.HasPrefix(key, project+`/`) {
+			missing.Delete(key)
+		}
+	}
+}
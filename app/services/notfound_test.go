@@ -0,0 +1,116 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err    error
+		kind   ErrorKind
+		status int
+	}{
+		{&azcore.ResponseError{StatusCode: http.StatusNotFound}, ErrorNotFound, http.StatusNotFound},
+		{fmt.Errorf(`wrapped: %w`, &azcore.ResponseError{StatusCode: http.StatusNotFound}), ErrorNotFound, http.StatusNotFound},
+		{&azcore.ResponseError{StatusCode: http.StatusForbidden}, ErrorAuth, http.StatusInternalServerError},
+		{&azcore.ResponseError{StatusCode: http.StatusTooManyRequests}, ErrorTransient, http.StatusServiceUnavailable},
+		{&azcore.ResponseError{StatusCode: http.StatusBadGateway}, ErrorTransient, http.StatusServiceUnavailable},
+		{&azcore.ResponseError{StatusCode: http.StatusConflict}, ErrorOther, http.StatusInternalServerError},
+		{&net.DNSError{Err: `no such host`, Name: `nowhere.blob.core.windows.net`}, ErrorTransient, http.StatusServiceUnavailable},
+		{context.DeadlineExceeded, ErrorTransient, http.StatusServiceUnavailable},
+		{ErrNotFound, ErrorNotFound, http.StatusNotFound},
+		{ErrLookupThrottled, ErrorTransient, http.StatusServiceUnavailable},
+		{errors.New(`something else`), ErrorOther, http.StatusInternalServerError},
+	}
+
+	for i, test := range tests {
+		if kind, status := ClassifyError(test.err); kind != test.kind || status != test.status {
+			t.Errorf(`test %v: expected %v/%v, got %v/%v`, i, test.kind, test.status, kind, status)
+		}
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	c := msrqc.New(context.Background())
+	one := 1
+	defer func() { cfg.Config = nil; missing.Flush(); unknownLookups = &lookupBudget{} }()
+	cfg.Config = &cfg.AppConfig{NotFound: cfg.NotFoundSettings{UnknownLookupsPerMinute: &one}}
+	bs := NewBlobService(`sites`, ``, `sites`)
+
+	// a remembered miss is answered without going to the container
+	rememberMissing(siteKey(`nothing`, DefaultRelease))
+	if err, status := bs.DownloadFiles(c, `nothing`, DefaultRelease); !errors.Is(err, ErrNotFound) || status != http.StatusNotFound {
+		t.Errorf(`expected a cached miss, got %v/%v`, err, status)
+	}
+	if Purge(`nothing`); knownMissing(siteKey(`nothing`, DefaultRelease)) {
+		t.Error(`purge should forget misses`)
+	}
+
+	// unknown projects share the lookup budget; known ones don't use it
+	if !allowLookup(`scan1`) {
+		t.Error(`first unknown lookup should be allowed`)
+	}
+	if allowLookup(`scan2`) {
+		t.Error(`second unknown lookup within the minute should be throttled`)
+	}
+	if err, status := bs.DownloadFiles(c, `scan3`, DefaultRelease); !errors.Is(err, ErrLookupThrottled) || status != http.StatusServiceUnavailable {
+		t.Errorf(`expected a throttled lookup, got %v/%v`, err, status)
+	}
+	rememberFound(`docs`, siteKey(`docs`, DefaultRelease))
+	if !allowLookup(`docs`) {
+		t.Error(`projects we have found should never be throttled`)
+	}
+}
+
+func TestLookupsBeforeActiveRelease(t *testing.T) {
+	c := msrqc.New(context.Background())
+	one := 1
+	defer func() { cfg.Config = nil; Purge(``); unknownLookups = &lookupBudget{}; missBudgets.Flush() }()
+	cfg.Config = &cfg.AppConfig{
+		NotFound: cfg.NotFoundSettings{UnknownLookupsPerMinute: &one},
+		Projects: map[string]cfg.ProjectSettings{`files`: {Mode: cfg.ModeBlob}},
+	}
+	sc, bs := newStubContainer(t, map[string][]byte{`files/index.html`: []byte(`x`)})
+
+	// a known miss, and then an unknown project once the budget is spent, are answered without asking for the active release
+	rememberMissing(siteKey(`gone`, DefaultRelease))
+	if release := bs.ActiveRelease(c, `gone`); release != DefaultRelease || sc.getCount(ActiveReleaseName(`gone`)) != 0 {
+		t.Errorf(`expected the default release without a lookup for a known miss, got %v`, release)
+	}
+	bs.ActiveRelease(c, `scan1`)
+	if release := bs.ActiveRelease(c, `scan2`); release != DefaultRelease || sc.getCount(ActiveReleaseName(`scan2`)) != 0 {
+		t.Errorf(`expected the default release without a lookup once throttled, got %v`, release)
+	}
+
+	// files of blob mode projects that are there cost nothing; each miss spends from the budget
+	for i := 0; i < 2; i++ {
+		if _, err := bs.DownloadFile(c, `files`, `files/index.html`); err != nil {
+			t.Fatal(err)
+		}
+		Purge(`files`)
+	}
+	if status, err := bs.DownloadFile(c, `files`, `files/random1`); status != http.StatusNotFound {
+		t.Errorf(`expected a miss, got %v/%v`, err, status)
+	}
+	if status, err := bs.DownloadFile(c, `files`, `files/random2`); !errors.Is(err, ErrLookupThrottled) || status != http.StatusServiceUnavailable {
+		t.Errorf(`expected a throttled lookup, got %v/%v`, err, status)
+	}
+	if sc.getCount(`files/random2`) != 0 {
+		t.Error(`throttled lookup went to the container`)
+	}
+
+	// the site manifest, with the site's passwords in it, is never served
+	sc.set(`files/`+SiteManifestName, []byte(`{}`))
+	if status, err := bs.DownloadFile(c, `files`, `files/`+SiteManifestName); status != http.StatusNotFound || sc.getCount(`files/`+SiteManifestName) != 0 {
+		t.Errorf(`expected the site manifest not to be looked up, got %v/%v`, err, status)
+	}
+}
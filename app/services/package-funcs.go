@@ -1,9 +1,20 @@
 package services
 
-func FindInCache(docPath string) ([]byte, bool) {
-	downloadData, found := cache.Get(docPath)
+// FindInCache returns the snapshot of a release of project, and whether it is fresh enough to serve without checking the container.
+// Stale snapshots are kept around so that we can keep serving them if the archive in the container turns out to be bad.
+// Snapshots that have dropped out of memory are reloaded from the disk cache, if there is one.
+func FindInCache(project, release string) (*Snapshot, bool) {
+	key := siteKey(project, release)
+	cached, found := cache.Get(key)
 	if found {
-		return downloadData.([]byte), found
+		snap := cached.(*Snapshot)
+		return snap, snap.fresh()
+	}
+	if release != blobFileRelease {
+		if snap := disk.load(key); snap != nil {
+			cache.Set(key, snap, 0)
+			return snap, snap.fresh()
+		}
 	}
 	return nil, false
 }
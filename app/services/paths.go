@@ -0,0 +1,98 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// MaxDocumentLength is the longest document path, within a project, we will look for
+	MaxDocumentLength = 1024
+	// MaxSegmentLength is the longest folder or file name we will look for
+	MaxSegmentLength = 255
+	// indexDocument is served for folders
+	indexDocument = `index.html`
+)
+
+var (
+	// ErrBadProject is returned for a project name that no project could have
+	ErrBadProject = errors.New(`bad project name`)
+	// ErrBadPath is returned for a document path that isn't in its plainest form
+	ErrBadPath = errors.New(`bad document path`)
+
+	projectNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+	// reservedProjects are the first segments of our own endpoints, and the folder of named releases in the container,
+	// none of which a project may be called
+	reservedProjects = map[string]bool{
+		`admin`:        true,
+		`auth`:         true,
+		`events`:       true,
+		`peers`:        true,
+		`publish`:      true,
+		releasesFolder: true,
+	}
+)
+
+// ValidProjectName reports whether project could name a project: a short plain name that isn't taken by one of our own paths
+func ValidProjectName(project string) bool {
+	return projectNamePattern.MatchString(project) && !reservedProjects[strings.ToLower(project)]
+}
+
+// CanonicalDocument returns the snapshot key, <project>/<path>, of the document a request asks for in project.
+// document is the rest of the decoded request path after the project, which starts with a slash unless it is empty,
+// as a *document route parameter does, and escapedPath the whole path as it was sent, or empty if there isn't one.
+// Rather than cleaning up paths that climb, repeat or hide separators, it turns them away, so that every document
+// has exactly one URL and no request can name anything outside its project. Folders get their index.html,
+// and the site manifest is never a document.
+func CanonicalDocument(project, document, escapedPath string) (string, int, error) {
+	if !ValidProjectName(project) {
+		return ``, http.StatusNotFound, ErrBadProject
+	}
+	// only the slash after the project; any more and the first segment is empty
+	document = strings.TrimPrefix(document, `/`)
+	if len(document) > MaxDocumentLength || !utf8.ValidString(document) || hasEncodedSeparator(escapedPath) {
+		return ``, http.StatusBadRequest, ErrBadPath
+	}
+	segments := strings.Split(document, `/`)
+	for i, segment := range segments {
+		switch {
+		case segment == `` && i < len(segments)-1,
+			segment == `.` || segment == `..`,
+			len(segment) > MaxSegmentLength,
+			strings.IndexFunc(segment, forbiddenPathRune) >= 0:
+			return ``, http.StatusBadRequest, ErrBadPath
+		}
+	}
+
+	if document == SiteManifestName {
+		// in blob mode it would be in the container like any other file, with the site's passwords in it
+		return ``, http.StatusNotFound, ErrNotFound
+	}
+
+	docPath := project + `/` + document
+	if document == `` || strings.HasSuffix(document, `/`) {
+		docPath += indexDocument
+	}
+	// belt and braces: whatever got through must already be clean
+	if path.Clean(docPath) != docPath || !strings.HasPrefix(docPath, project+`/`) {
+		return ``, http.StatusBadRequest, ErrBadPath
+	}
+
+	return docPath, http.StatusOK, nil
+}
+
+// hasEncodedSeparator reports whether escapedPath hides a slash, backslash or NUL behind percent-encoding
+func hasEncodedSeparator(escapedPath string) bool {
+	lower := strings.ToLower(escapedPath)
+
+	return strings.Contains(lower, `%2f`) || strings.Contains(lower, `%5c`) || strings.Contains(lower, `%00`)
+}
+
+// forbiddenPathRune is true of backslashes, control characters and NUL, none of which belong in a document path
+func forbiddenPathRune(r rune) bool {
+	return r == '\\' || r < 0x20 || r == 0x7f || r == utf8.RuneError
+}
@@ -0,0 +1,238 @@
+package services
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/elephant-insurance/go-microservice-arch/v2/sec"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+func TestCanonicalDocument(t *testing.T) {
+	tests := []struct {
+		rawPath  string
+		expected string
+		status   int
+	}{
+		{`/docs`, `docs/index.html`, http.StatusOK},
+		{`/docs/`, `docs/index.html`, http.StatusOK},
+		{`/docs/guide/`, `docs/guide/index.html`, http.StatusOK},
+		{`/docs/guide/css/site.css`, `docs/guide/css/site.css`, http.StatusOK},
+		{`/docs/release%20notes.html`, `docs/release notes.html`, http.StatusOK},
+		{`/docs/%C3%A9t%C3%A9.html`, `docs/été.html`, http.StatusOK},
+		{`/docs/.ms-sites.json`, ``, http.StatusNotFound},
+		{`/docs/guide/.ms-sites.json`, `docs/guide/.ms-sites.json`, http.StatusOK},
+		{`/docs/../handbook/index.html`, ``, http.StatusBadRequest},
+		{`/docs/guide/./index.html`, ``, http.StatusBadRequest},
+		{`/docs/%2e%2e/handbook/index.html`, ``, http.StatusBadRequest},
+		{`/docs/guide%2F..%2F..%2Fhandbook`, ``, http.StatusBadRequest},
+		{`/docs/guide%5c..%5chandbook`, ``, http.StatusBadRequest},
+		{`/docs/guide\..\handbook`, ``, http.StatusBadRequest},
+		{`/docs/index.html%00.png`, ``, http.StatusBadRequest},
+		{`/docs/a%0Ab`, ``, http.StatusBadRequest},
+		{`/docs//etc/passwd`, ``, http.StatusBadRequest},
+		{`/docs/guide//index.html`, ``, http.StatusBadRequest},
+		{`/docs//`, ``, http.StatusBadRequest},
+		{`/docs/%FF.html`, ``, http.StatusBadRequest},
+		{`/docs/` + strings.Repeat(`a`, MaxSegmentLength+1), ``, http.StatusBadRequest},
+		{`/docs/` + strings.Repeat(`a/`, MaxDocumentLength/2+1), ``, http.StatusBadRequest},
+		{`/admin/index.html`, ``, http.StatusNotFound},
+		{`/releases/docs/v2.tar.gz`, ``, http.StatusNotFound},
+		{`/Publish/`, ``, http.StatusNotFound},
+		{`/.hidden/index.html`, ``, http.StatusNotFound},
+		{`/` + strings.Repeat(`p`, 129) + `/`, ``, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		project, document, escaped := splitRequestPath(t, test.rawPath)
+		docPath, status, err := CanonicalDocument(project, document, escaped)
+		if docPath != test.expected || status != test.status || (err == nil) != (status == http.StatusOK) {
+			t.Errorf(`%v: got %q, %v, %v; expected %q, %v`, test.rawPath, docPath, err, status, test.expected, test.status)
+		}
+	}
+}
+
+func TestValidProjectName(t *testing.T) {
+	for _, project := range []string{`docs`, `agent-tools`, `v2.handbook`, `A_1`} {
+		if !ValidProjectName(project) {
+			t.Errorf(`%q should be a valid project name`, project)
+		}
+	}
+	for _, project := range []string{``, `.docs`, `-docs`, `docs/guide`, `docs\guide`, `..`, `admin`, `AUTH`, `events`, `peers`, `publish`, `releases`} {
+		if ValidProjectName(project) {
+			t.Errorf(`%q shouldn't be a valid project name`, project)
+		}
+	}
+}
+
+// FuzzCanonicalDocument makes sure that no request path, however it is written, names a document outside its project.
+// Run with go test -fuzz FuzzCanonicalDocument ./app/services
+func FuzzCanonicalDocument(f *testing.F) {
+	for _, seed := range []string{
+		`/docs/guide/index.html`, `/docs/../handbook/`, `/docs/%2e%2e%2fhandbook`, `/docs/..%5c..%5cwindows`,
+		`/docs/a%00b`, `/releases/docs/v1.tar.gz`, `//docs/x`, `/docs/.`, `/docs/..`, `/docs/%252e%252e/x`,
+		`/docs/guide%2F..%2F..%2Fsecret`, `/docs/‮/x`, `/docs/é/`, `/docs?x=/../y`, `/docs#/../y`,
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, rawPath string) {
+		u, err := url.Parse(rawPath)
+		if err != nil || !strings.HasPrefix(u.Path, `/`) {
+			return
+		}
+		project, _, _ := strings.Cut(strings.TrimPrefix(u.Path, `/`), `/`)
+		docPath, _, err := CanonicalDocument(project, strings.TrimPrefix(u.Path, `/`+project), u.EscapedPath())
+		if err != nil {
+			return
+		}
+
+		switch {
+		case !ValidProjectName(project):
+			t.Fatalf(`%q: accepted project %q`, rawPath, project)
+		case !strings.HasPrefix(docPath, project+`/`):
+			t.Fatalf(`%q: %q is outside project %q`, rawPath, docPath, project)
+		case path.Clean(docPath) != docPath, path.Clean(`/`+docPath) != `/`+docPath:
+			t.Fatalf(`%q: %q isn't clean`, rawPath, docPath)
+		case strings.ContainsAny(docPath, "\\\x00"):
+			t.Fatalf(`%q: %q holds a backslash or NUL`, rawPath, docPath)
+		case strings.HasPrefix(docPath, releasesFolder+`/`):
+			t.Fatalf(`%q: %q could name a release archive`, rawPath, docPath)
+		case len(docPath) > len(project)+1+MaxDocumentLength+len(indexDocument):
+			t.Fatalf(`%q: %q is too long`, rawPath, docPath)
+		}
+		for _, segment := range strings.Split(docPath, `/`) {
+			if segment == `..` || segment == `.` || segment == `` {
+				t.Fatalf(`%q: %q has segment %q`, rawPath, docPath, segment)
+			}
+		}
+	})
+}
+
+// FuzzBlobFileName makes sure that the blob a blob mode project fetches for a request path is the document it asked for,
+// once the blob SDK has put the name in its request URL. Run with go test -fuzz FuzzBlobFileName ./app/services
+func FuzzBlobFileName(f *testing.F) {
+	for _, seed := range []string{
+		`/docs/guide/index.html`, `/docs/a%3Fcomp=list`, `/docs/a%23b`, `/docs/a%25252e%25252e/x`, `/docs/%252e%252e/x`,
+		`/docs/a b.html`, `/docs/a;b`, `/docs/%2e%2e`, `/docs/é/`, `/docs/a+b`,
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, rawPath string) {
+		u, err := url.Parse(rawPath)
+		if err != nil || !strings.HasPrefix(u.Path, `/`) {
+			return
+		}
+		project, _, _ := strings.Cut(strings.TrimPrefix(u.Path, `/`), `/`)
+		docPath, _, err := CanonicalDocument(project, strings.TrimPrefix(u.Path, `/`+project), u.EscapedPath())
+		if err != nil {
+			return
+		}
+
+		switch requested, ok := containerRequest(docPath); {
+		case !ok:
+			t.Fatalf(`%q: blob %q doesn't make a plain request`, rawPath, docPath)
+		case requested != docPath:
+			t.Fatalf(`%q: blob %q reaches the container as %q`, rawPath, docPath, requested)
+		case !strings.HasPrefix(requested, project+`/`):
+			t.Fatalf(`%q: blob %q is outside project %q`, rawPath, requested, project)
+		}
+	})
+}
+
+// FuzzArchiveNames makes sure that whatever names a release, from config or the active release blob,
+// the archives we look for are the project's own. Run with go test -fuzz FuzzArchiveNames ./app/services
+func FuzzArchiveNames(f *testing.F) {
+	for _, seed := range []string{
+		``, DefaultRelease, `v1`, `../handbook`, `v1/../../handbook`, `..`, `v1?comp=list`, `v1#x`, `%2e%2e`, `v1/extra`, `active`,
+	} {
+		f.Add(`docs`, seed)
+	}
+
+	f.Fuzz(func(t *testing.T, project, release string) {
+		if !ValidProjectName(project) {
+			return
+		}
+		for _, name := range ArchiveNames(project, release) {
+			requested, ok := containerRequest(name)
+			switch {
+			case !ok || requested != name:
+				t.Fatalf(`%q: archive %q reaches the container as %q`, release, name, requested)
+			case release == `` || release == DefaultRelease:
+				if strings.Contains(name, `/`) || !strings.HasPrefix(name, project+`.`) {
+					t.Fatalf(`%q: default archive %q isn't the project's`, release, name)
+				}
+			case path.Dir(name) != releasesFolder+`/`+project:
+				t.Fatalf(`%q: archive %q isn't one of the project's releases`, release, name)
+			case !strings.HasPrefix(path.Base(name), release+`.`):
+				t.Fatalf(`%q: archive %q is for another release`, release, name)
+			}
+		}
+	})
+}
+
+// FuzzSignedURLAllows makes sure that a link signed for a folder, however its scope is written or changed,
+// lets in only the documents under that folder. Run with go test -fuzz FuzzSignedURLAllows ./app/services
+func FuzzSignedURLAllows(f *testing.F) {
+	for _, seed := range [][3]string{
+		{`reports`, ``, `reports/q1.pdf`}, {`reports`, ``, `reportsx/q1.pdf`}, {`reports`, `reports/../`, `handbook/x`},
+		{`reports/2024`, `reports/`, `reports/2023/x.pdf`}, {`reports`, `/`, `index.html`}, {`a/b`, `a/`, `a/c/d`},
+	} {
+		f.Add(seed[0], seed[1], seed[2])
+	}
+
+	f.Fuzz(func(t *testing.T, scope, tampered, document string) {
+		defer func() { cfg.Config = nil }()
+		cfg.Config = &cfg.AppConfig{Security: sec.Settings{AccessKey1: `new-key`, AccessKey2: `old-key`}}
+		signed, _, err := SignURL(`docs`, ``, scope, 0)
+		if err != nil {
+			return
+		}
+		u, err := url.Parse(signed.URL)
+		if err != nil {
+			t.Fatalf(`%q: bad signed URL %q`, scope, signed.URL)
+		}
+		q := u.Query()
+		if tampered != `` {
+			q.Set(ScopeParam, tampered)
+		}
+		docPath, _, err := CanonicalDocument(`docs`, `/`+document, ``)
+		if err != nil || !SignedURLAllows(`docs`, docPath, q) {
+			return
+		}
+
+		if q.Get(ScopeParam) != signed.Scope {
+			t.Fatalf(`%q: link signed for %q accepted with scope %q`, scope, signed.Scope, q.Get(ScopeParam))
+		}
+		if !strings.HasPrefix(docPath, `docs/`+signed.Scope) {
+			t.Fatalf(`%q: link signed for %q let in %q`, scope, signed.Scope, docPath)
+		}
+	})
+}
+
+// containerRequest returns the blob a request for name reaches, once the blob SDK has put it in the request URL,
+// and false if the URL has a query or fragment the name didn't ask for
+func containerRequest(name string) (string, bool) {
+	const container = `https://account.blob.core.windows.net/sites`
+	u, err := url.Parse(runtime.JoinPaths(container, blobPath(name)))
+	if err != nil || u.RawQuery != `` || u.Fragment != `` {
+		return ``, false
+	}
+
+	return strings.TrimPrefix(u.Path, `/sites/`), true
+}
+
+// splitRequestPath splits a request path the way the document routes do: the document keeps the slash after the project
+func splitRequestPath(t *testing.T, rawPath string) (string, string, string) {
+	u, err := url.Parse(rawPath)
+	if err != nil {
+		t.Fatalf(`%v: %v`, rawPath, err)
+	}
+	project, _, _ := strings.Cut(strings.TrimPrefix(u.Path, `/`), `/`)
+
+	return project, strings.TrimPrefix(u.Path, `/`+project), u.EscapedPath()
+}
@@ -0,0 +1,246 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/clicker"
+	"github.com/elephant-insurance/go-microservice-arch/v2/log"
+	"github.com/elephant-insurance/go-microservice-arch/v2/mbuf"
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+const (
+	// PeerInvalidatePath is where each replica accepts invalidations from the others
+	PeerInvalidatePath = `/peers/invalidate`
+	// PeerKeyHeader carries the key the replicas share; never the URL, which ends up in access logs
+	PeerKeyHeader = `X-Peer-Key`
+)
+
+// invalidation actions
+const (
+	// PeerPurge drops a project, or everything, from the cache
+	PeerPurge = `purge`
+	// PeerRefresh loads a project again from the container
+	PeerRefresh = `refresh`
+	// PeerDrop drops a single release of a project
+	PeerDrop = `drop`
+	// PeerActivate switches the release served for a project
+	PeerActivate = `activate`
+	// PeerEvent passes on a storage event, so that each replica handles it as if Event Grid had sent it
+	PeerEvent = `event`
+)
+
+var (
+	// Peers tells the other replicas about changes we make to the cache
+	Peers PeerNotifier = noPeers{}
+
+	// instanceID tells our own notifications apart, in case we are on our own peer list
+	instanceID = newInstanceID()
+
+	PeerNotificationsSent     *clicker.Clicker = &clicker.Clicker{}
+	PeerNotificationsReceived *clicker.Clicker = &clicker.Clicker{}
+)
+
+// Invalidation is a change to the cache that every replica should make
+type Invalidation struct {
+	Origin  string        `json:"origin"`
+	Action  string        `json:"action"`
+	Project string        `json:"project,omitempty"`
+	Release string        `json:"release,omitempty"`
+	Event   *StorageEvent `json:"event,omitempty"`
+	Sent    time.Time     `json:"sent"`
+}
+
+// PeerNotifier passes invalidations on to the other replicas.
+// Notify must return at once: delivery happens in the background.
+type PeerNotifier interface {
+	Notify(Invalidation)
+	Diagnostics() map[string]interface{}
+}
+
+// InitializePeers sets up Peers from the configured peer list, or the test double if asked for
+func InitializePeers(c context.Context) {
+	if cfg.Config == nil {
+		return
+	}
+
+	ps := cfg.Config.Peers
+	switch {
+	case ps.Test:
+		Peers = NewTestPeers()
+		log.ForFunc(c).Info("recording peer notifications instead of sending them")
+	case len(cfg.Config.PeerURLs()) > 0:
+		Peers = newHTTPPeers(cfg.Config.PeerURLs(), ps.Key)
+		log.ForFunc(c).WithConsoleField("peers", len(cfg.Config.PeerURLs())).Info("peer notification ready")
+	}
+}
+
+// NotifyPeers tells the other replicas about a change we have just made
+func NotifyPeers(action, project, release string) {
+	Peers.Notify(Invalidation{Action: action, Project: project, Release: release})
+}
+
+// NotifyPeersOfEvent passes a storage event on to the other replicas
+func NotifyPeersOfEvent(event StorageEvent) {
+	Peers.Notify(Invalidation{Action: PeerEvent, Event: &event})
+}
+
+// ApplyInvalidation makes a change another replica has told us about.
+// We never pass it on, so that notifications can't go round in circles.
+func (bs *BlobService) ApplyInvalidation(c msrqc.Context, inv Invalidation) bool {
+	if inv.Origin == instanceID {
+		return false
+	}
+	PeerNotificationsReceived.Click(1)
+	lw := log.ForFunc(c).SetName(inv.Project).WithConsoleField("action", inv.Action).WithConsoleField("origin", inv.Origin)
+
+	switch inv.Action {
+	case PeerPurge:
+		Purge(inv.Project)
+	case PeerRefresh:
+		// don't keep the sender waiting while we download
+		go bs.refreshInBackground(inv.Project, ``)
+	case PeerDrop:
+		dropKey(siteKey(inv.Project, inv.Release))
+	case PeerActivate:
+		activeReleases.Set(inv.Project, inv.Release, 0)
+	case PeerEvent:
+		if inv.Event == nil {
+			return false
+		}
+		bs.HandleStorageEvent(c, *inv.Event)
+	default:
+		lw.Warn("unknown peer invalidation")
+		return false
+	}
+	lw.Debug("peer invalidation applied")
+
+	return true
+}
+
+// PeerDiagnostics reports on notifications to and from the other replicas
+func PeerDiagnostics() map[string]interface{} {
+	rtn := map[string]interface{}{
+		`instance`: instanceID,
+		`sent`:     PeerNotificationsSent.Clicks,
+		`received`: PeerNotificationsReceived.Clicks,
+	}
+	for k, v := range Peers.Diagnostics() {
+		rtn[k] = v
+	}
+
+	return rtn
+}
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// stamp fills in who sent inv and when
+func stamp(inv Invalidation) Invalidation {
+	inv.Origin = instanceID
+	inv.Sent = time.Now().UTC()
+	return inv
+}
+
+// noPeers is used when we are the only replica
+type noPeers struct{}
+
+func (noPeers) Notify(Invalidation)                 {}
+func (noPeers) Diagnostics() map[string]interface{} { return map[string]interface{}{`peers`: 0} }
+
+// httpPeers posts each invalidation to every peer, through a message relay per peer that retries while the peer is down
+type httpPeers struct {
+	relays map[string]mbuf.MessageRelay
+}
+
+func newHTTPPeers(peerURLs []string, key string) *httpPeers {
+	single := 1
+	hp := &httpPeers{relays: map[string]mbuf.MessageRelay{}}
+	for _, peer := range peerURLs {
+		relayURL := strings.TrimSuffix(peer, `/`) + PeerInvalidatePath
+		// one message at a time: an invalidation that waits for a full buffer is no use
+		hp.relays[peer] = mbuf.New(&mbuf.Settings{
+			RelayURL:  relayURL,
+			MaxLength: &single,
+			Marshaler: &keyedMarshaler{HTTPMarshaler: mbuf.NewDefaultHTTPMarshaler(relayURL), key: key},
+		})
+	}
+
+	return hp
+}
+
+// keyedMarshaler adds the peer key to each request the default marshaler makes
+type keyedMarshaler struct {
+	mbuf.HTTPMarshaler
+	key string
+}
+
+func (km *keyedMarshaler) Marshal(msgs []interface{}) (*http.Request, error) {
+	rq, err := km.HTTPMarshaler.Marshal(msgs)
+	if err != nil {
+		return nil, err
+	}
+	rq.Header.Set(PeerKeyHeader, km.key)
+
+	return rq, nil
+}
+
+func (hp *httpPeers) Notify(inv Invalidation) {
+	inv = stamp(inv)
+	for _, relay := range hp.relays {
+		relay.Add(inv)
+		PeerNotificationsSent.Click(1)
+	}
+}
+
+func (hp *httpPeers) Diagnostics() map[string]interface{} {
+	rtn := map[string]interface{}{`peers`: len(hp.relays)}
+	for peer, relay := range hp.relays {
+		rtn[peer] = relay.Diagnostics()
+	}
+
+	return rtn
+}
+
+// TestPeers records invalidations instead of sending them, for tests and local runs
+type TestPeers struct {
+	Relay *mbuf.TestMessageRelay
+}
+
+// NewTestPeers returns a PeerNotifier that remembers everything it is asked to send
+func NewTestPeers() *TestPeers {
+	return &TestPeers{Relay: mbuf.NewTestMessageRelay()}
+}
+
+func (tp *TestPeers) Notify(inv Invalidation) {
+	tp.Relay.Add(stamp(inv))
+	PeerNotificationsSent.Click(1)
+}
+
+func (tp *TestPeers) Diagnostics() map[string]interface{} {
+	return tp.Relay.Diagnostics()
+}
+
+// Sent returns the invalidations recorded so far
+func (tp *TestPeers) Sent() []Invalidation {
+	rtn := []Invalidation{}
+	for _, msg := range tp.Relay.Messages {
+		if msg == nil {
+			continue
+		}
+		if inv, ok := msg.Item.(Invalidation); ok {
+			rtn = append(rtn, inv)
+		}
+	}
+
+	return rtn
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+)
+
+func TestPeerNotifications(t *testing.T) {
+	c := msrqc.New(context.Background())
+	tp := NewTestPeers()
+	defer func() { Peers = noPeers{}; cache.Flush(); activeReleases.Flush() }()
+	Peers = tp
+	bs := NewBlobService(`sites`, ``, `sites`)
+
+	NotifyPeers(PeerActivate, `docs`, `v2`)
+	sent := tp.Sent()
+	if len(sent) != 1 || sent[0].Origin != instanceID || sent[0].Action != PeerActivate || sent[0].Release != `v2` {
+		t.Fatalf(`notification not recorded: %+v`, sent)
+	}
+
+	// our own notifications come straight back if we are on our own peer list
+	if bs.ApplyInvalidation(c, sent[0]) {
+		t.Error(`our own invalidation should be ignored`)
+	}
+
+	fromPeer := Invalidation{Origin: `another`, Action: PeerActivate, Project: `docs`, Release: `v2`}
+	if !bs.ApplyInvalidation(c, fromPeer) || bs.ActiveRelease(c, `docs`) != `v2` {
+		t.Error(`activation from a peer not applied`)
+	}
+	cache.Set(siteKey(`docs`, `v2`), newSnapshot(`docs`), 0)
+	fromPeer.Action = PeerDrop
+	if !bs.ApplyInvalidation(c, fromPeer) {
+		t.Error(`drop from a peer not applied`)
+	}
+	if _, found := cache.Get(siteKey(`docs`, `v2`)); found {
+		t.Error(`dropped release still cached`)
+	}
+	if len(tp.Sent()) != 1 {
+		t.Error(`invalidations from peers should never be passed on`)
+	}
+}
+
+func TestHTTPPeers(t *testing.T) {
+	received := make(chan []Invalidation, 1)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != PeerInvalidatePath || r.Header.Get(PeerKeyHeader) != `secret` || r.URL.RawQuery != `` {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		invalidations := []Invalidation{}
+		json.NewDecoder(r.Body).Decode(&invalidations)
+		received <- invalidations
+	}))
+	defer peer.Close()
+
+	newHTTPPeers([]string{peer.URL + `/`}, `secret`).Notify(Invalidation{Action: PeerPurge, Project: `docs`})
+
+	select {
+	case invalidations := <-received:
+		if len(invalidations) != 1 || invalidations[0].Action != PeerPurge || invalidations[0].Project != `docs` || invalidations[0].Origin != instanceID {
+			t.Errorf(`peer got the wrong invalidations: %+v`, invalidations)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error(`peer never heard about the purge`)
+	}
+}
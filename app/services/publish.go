@@ -0,0 +1,152 @@
+package services
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/elephant-insurance/go-microservice-arch/v2/log"
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+	goCache "github.com/patrickmn/go-cache"
+)
+
+const (
+	// activeReleaseBlob is the blob in a project's releases folder that names its active release
+	activeReleaseBlob = `active`
+)
+
+var (
+	releaseNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+	// activeReleases remembers each project's active release so that we don't look it up on every miss
+	activeReleases = goCache.New(cacheExpirationSeconds*time.Second, cachePurgeSeconds*time.Second)
+)
+
+// ActiveReleaseName returns the name of the blob pointing at the active release of a project
+func ActiveReleaseName(project string) string {
+	return releasesFolder + `/` + project + `/` + activeReleaseBlob
+}
+
+// IsReservedRelease reports whether name is used by ms-sites itself and can't be published as a release
+func IsReservedRelease(name string) bool {
+	return strings.EqualFold(name, DefaultRelease) || strings.EqualFold(name, activeReleaseBlob)
+}
+
+// ValidReleaseName reports whether release could name a published release: a short plain name, safe in blob names and cookies
+func ValidReleaseName(release string) bool {
+	return releaseNamePattern.MatchString(release) && !IsReservedRelease(release)
+}
+
+// UploadRelease writes archive to the container as a new release of project.
+// Any copy of the same release in another format is removed, so that lookups find the new one.
+func (bs *BlobService) UploadRelease(c msrqc.Context, project, release string, format ArchiveFormat, archive []byte) (int, error) {
+	lw := log.ForFunc(c)
+	client, err := bs.initializeClient(c)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	blobName := archiveBase(project, release) + format.Extension()
+	contentType := format.MIMEType()
+	_, err = client.UploadBuffer(c, bs.containerName, blobPath(blobName), archive, &azblob.UploadBufferOptions{
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentType: &contentType},
+	})
+	if err != nil {
+		lw.WithError(err).Error("error uploading release archive")
+		return http.StatusInternalServerError, err
+	}
+
+	for _, name := range ArchiveNames(project, release) {
+		if name == blobName {
+			continue
+		}
+		_, err = client.DeleteBlob(c, bs.containerName, blobPath(name), nil)
+		if err != nil && !isNotFound(err) {
+			lw.SetName(name).WithError(err).Error("error removing old release archive")
+		}
+	}
+	// the release may have been asked for, and found missing, before it was published
+	missing.Delete(siteKey(project, release))
+
+	return http.StatusCreated, nil
+}
+
+// ActivateRelease makes release the one served for project, once it has been uploaded
+func (bs *BlobService) ActivateRelease(c msrqc.Context, project, release string) (int, error) {
+	lw := log.ForFunc(c)
+	client, err := bs.initializeClient(c)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// make sure the release exists before we point anyone at it
+	dr, _, err := bs.findArchive(c, client, project, release, ``, &azblob.DownloadStreamOptions{
+		Range: blob.HTTPRange{Count: 1},
+	})
+	if err != nil {
+		lw.WithError(err).Error("error finding release to activate")
+		_, status := ClassifyError(err)
+		return status, err
+	}
+	dr.Body.Close()
+
+	_, err = client.UploadBuffer(c, bs.containerName, blobPath(ActiveReleaseName(project)), []byte(release), nil)
+	if err != nil {
+		lw.WithError(err).Error("error writing active release")
+		return http.StatusInternalServerError, err
+	}
+	activeReleases.Set(project, release, 0)
+
+	return http.StatusOK, nil
+}
+
+// ActiveRelease returns the release of project that has been activated through the publish API,
+// or the default release if none has been.
+// Projects we know are missing, and unknown projects once the lookup budget is spent, get the default release
+// without asking the container, so that DownloadFiles can turn them away.
+func (bs *BlobService) ActiveRelease(c msrqc.Context, project string) string {
+	if release, found := activeReleases.Get(project); found {
+		return release.(string)
+	}
+	if _, found := missing.Get(siteKey(project, DefaultRelease)); found || !allowLookup(project) {
+		return DefaultRelease
+	}
+
+	lw := log.ForFunc(c)
+	client, err := bs.initializeClient(c)
+	if err != nil {
+		return DefaultRelease
+	}
+
+	release := DefaultRelease
+	dr, err := client.DownloadStream(c, bs.containerName, blobPath(ActiveReleaseName(project)), nil)
+	if err != nil {
+		if !isNotFound(err) {
+			// don't remember anything we aren't sure of
+			lw.WithError(err).Error("error looking up active release")
+			return DefaultRelease
+		}
+	} else {
+		name, errRead := io.ReadAll(dr.Body)
+		dr.Body.Close()
+		if errRead != nil {
+			lw.WithError(errRead).Error("error reading active release")
+			return DefaultRelease
+		}
+		trimmed := strings.TrimSpace(string(name))
+		switch {
+		case trimmed == ``:
+		case trimmed != DefaultRelease && !ValidReleaseName(trimmed):
+			lw.SetName(trimmed).Error("active release isn't a release name")
+		default:
+			release = trimmed
+		}
+	}
+
+	activeReleases.Set(project, release, 0)
+	return release
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/clicker"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+	goCache "github.com/patrickmn/go-cache"
+)
+
+// rate limits
+const (
+	RateLimitClient         = `client`
+	RateLimitProject        = `project`
+	RateLimitClientBackend  = `client-backend`
+	RateLimitProjectBackend = `project-backend`
+)
+
+const (
+	defaultClientPerMinute         = 1200
+	defaultProjectPerMinute        = 0
+	defaultClientBackendPerMinute  = 120
+	defaultProjectBackendPerMinute = 600
+	defaultMaxRateLimitClients     = 100000
+	// a bucket left alone this long is full again anyway, so it can go
+	rateBucketIdleSeconds = 5 * 60
+	// overflowBucket is shared by the clients that turn up once we are tracking as many as we may
+	overflowBucket = `overflow`
+)
+
+var (
+	rateBuckets = goCache.New(rateBucketIdleSeconds*time.Second, rateBucketIdleSeconds*time.Second)
+
+	RateLimited = map[string]*clicker.Clicker{
+		RateLimitClient:         {},
+		RateLimitProject:        {},
+		RateLimitClientBackend:  {},
+		RateLimitProjectBackend: {},
+	}
+)
+
+// RateLimitError is returned when a client or project has used up one of its rate limits
+type RateLimitError struct {
+	Limit string `json:"limit"`
+	// RetryAfter is how long until the limit allows another request
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf(`rate limit %v exceeded`, e.Limit)
+}
+
+// rateLimits holds the limits in effect, per minute
+type rateLimits struct {
+	client, project, clientBackend, projectBackend, maxClients int
+}
+
+func rateLimitSettings() rateLimits {
+	rtn := rateLimits{defaultClientPerMinute, defaultProjectPerMinute, defaultClientBackendPerMinute, defaultProjectBackendPerMinute, defaultMaxRateLimitClients}
+	if cfg.Config == nil {
+		return rtn
+	}
+	rl := cfg.Config.RateLimits
+	for _, setting := range []struct {
+		to   *int
+		from *int
+	}{
+		{&rtn.client, rl.ClientPerMinute},
+		{&rtn.project, rl.ProjectPerMinute},
+		{&rtn.clientBackend, rl.ClientBackendPerMinute},
+		{&rtn.projectBackend, rl.ProjectBackendPerMinute},
+		{&rtn.maxClients, rl.MaxClients},
+	} {
+		if setting.from != nil && *setting.from >= 0 {
+			*setting.to = *setting.from
+		}
+	}
+
+	return rtn
+}
+
+// AllowRequest spends a request from the budgets of client and of project, which may be empty for requests that aren't for a project.
+// It returns a RateLimitError if either has run out.
+func AllowRequest(client net.IP, project string) error {
+	limits := rateLimitSettings()
+	if err := spend(RateLimitClient, client.String(), limits.client, limits.maxClients); err != nil {
+		return err
+	}
+
+	return spend(RateLimitProject, project, limits.project, limits.maxClients)
+}
+
+// AllowBackendRequest spends a request that the cache can't answer, which goes to the container,
+// from the tighter backend budgets of client and project. It returns a RateLimitError if either has run out.
+func AllowBackendRequest(client net.IP, project string) error {
+	limits := rateLimitSettings()
+	if err := spend(RateLimitClientBackend, client.String(), limits.clientBackend, limits.maxClients); err != nil {
+		return err
+	}
+
+	return spend(RateLimitProjectBackend, project, limits.projectBackend, limits.maxClients)
+}
+
+// spend takes a token from the bucket of key under limit, if the limit is on
+func spend(limit, key string, perMinute, maxBuckets int) error {
+	if perMinute <= 0 || key == `` {
+		return nil
+	}
+	taken, wait := rateBucket(limit+`:`+key, limit+`:`+overflowBucket, maxBuckets).takeOrWait(perMinute)
+	if taken {
+		return nil
+	}
+	RateLimited[limit].Click(1)
+
+	return &RateLimitError{Limit: limit, RetryAfter: wait}
+}
+
+// rateBucket returns the bucket for key, starting one if there isn't one and we have room, or sharing overflow if we haven't
+func rateBucket(key, overflow string, maxBuckets int) *lookupBudget {
+	if cached, found := rateBuckets.Get(key); found {
+		// keep it while it is in use
+		rateBuckets.SetDefault(key, cached)
+		return cached.(*lookupBudget)
+	}
+	if maxBuckets > 0 && rateBuckets.ItemCount() >= maxBuckets {
+		key = overflow
+		if cached, found := rateBuckets.Get(key); found {
+			return cached.(*lookupBudget)
+		}
+	}
+	bucket := &lookupBudget{}
+	if rateBuckets.Add(key, bucket, goCache.DefaultExpiration) != nil {
+		// somebody else just started it
+		if cached, found := rateBuckets.Get(key); found {
+			return cached.(*lookupBudget)
+		}
+	}
+
+	return bucket
+}
+
+// RateLimitDiagnostics reports how many clients and projects we are tracking, and how often each limit has turned requests away
+func RateLimitDiagnostics() map[string]interface{} {
+	rtn := map[string]interface{}{`tracked`: rateBuckets.ItemCount()}
+	for limit, clicks := range RateLimited {
+		rtn[limit] = clicks.Clicks
+	}
+
+	return rtn
+}
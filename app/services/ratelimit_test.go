@@ -0,0 +1,63 @@
+package services
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+func TestRateLimit(t *testing.T) {
+	defer func() { cfg.Config = nil; rateBuckets.Flush() }()
+	two, off, one := 2, 0, 1
+	cfg.Config = &cfg.AppConfig{RateLimits: cfg.RateLimitSettings{
+		ClientPerMinute:         &two,
+		ProjectPerMinute:        &off,
+		ClientBackendPerMinute:  &off,
+		ProjectBackendPerMinute: &one,
+	}}
+	rateBuckets.Flush()
+
+	client, other := net.ParseIP(`10.0.0.1`), net.ParseIP(`10.0.0.2`)
+	for i := 0; i < 2; i++ {
+		if err := AllowRequest(client, `docs`); err != nil {
+			t.Fatalf(`request %v should be allowed: %v`, i, err)
+		}
+	}
+	err := AllowRequest(client, `docs`)
+	var limited *RateLimitError
+	if !errors.As(err, &limited) || limited.Limit != RateLimitClient || limited.RetryAfter <= 0 {
+		t.Fatalf(`third request should be limited with a wait: %v`, err)
+	}
+	if err := AllowRequest(other, `docs`); err != nil {
+		t.Errorf(`another client should have its own budget: %v`, err)
+	}
+
+	if err := AllowBackendRequest(client, `docs`); err != nil {
+		t.Errorf(`first backend request should be allowed: %v`, err)
+	}
+	if err := AllowBackendRequest(other, `docs`); !errors.As(err, &limited) || limited.Limit != RateLimitProjectBackend {
+		t.Errorf(`project backend budget should be shared by clients: %v`, err)
+	}
+	if err := AllowBackendRequest(other, `widgets`); err != nil {
+		t.Errorf(`another project should have its own backend budget: %v`, err)
+	}
+}
+
+func TestRateLimitOverflow(t *testing.T) {
+	defer func() { cfg.Config = nil; rateBuckets.Flush() }()
+	one := 1
+	cfg.Config = &cfg.AppConfig{RateLimits: cfg.RateLimitSettings{ClientPerMinute: &one, MaxClients: &one}}
+	rateBuckets.Flush()
+
+	if err := AllowRequest(net.ParseIP(`10.0.0.1`), ``); err != nil {
+		t.Fatalf(`first client should be allowed: %v`, err)
+	}
+	if err := AllowRequest(net.ParseIP(`10.0.0.2`), ``); err != nil {
+		t.Fatalf(`first overflow client should be allowed: %v`, err)
+	}
+	if err := AllowRequest(net.ParseIP(`10.0.0.3`), ``); err == nil {
+		t.Errorf(`clients beyond MaxClients should share one budget`)
+	}
+}
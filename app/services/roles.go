@@ -0,0 +1,45 @@
+package services
+
+import (
+	"path"
+	"strings"
+
+	enum "github.com/elephant-insurance/enumerations/v2"
+)
+
+// RequiredRoles returns the agent roles that may see docPath, a path within a project, under rules from cfg.RolesFor,
+// and whether any rule covers it at all; if none does, anybody the project lets in may see it.
+// A pattern ending in / covers everything under it; any other pattern is matched against the whole path, as by path.Match.
+// When several patterns match, the longest wins. A pattern that can't be matched covers everything,
+// so that a mistake in the rules locks the site rather than opening it.
+func RequiredRoles(rules map[string][]string, docPath string) ([]enum.AgentRoleID, bool) {
+	docPath = strings.TrimPrefix(docPath, `/`)
+	best, found := ``, false
+	var roles []string
+	for pattern, patternRoles := range rules {
+		if !rolePatternMatches(pattern, docPath) || (found && (len(pattern) < len(best) || (len(pattern) == len(best) && pattern > best))) {
+			continue
+		}
+		best, roles, found = pattern, patternRoles, true
+	}
+	if !found {
+		return nil, false
+	}
+
+	rtn := make([]enum.AgentRoleID, 0, len(roles))
+	for _, role := range roles {
+		rtn = append(rtn, enum.AgentRoleID(role))
+	}
+
+	return rtn, true
+}
+
+func rolePatternMatches(pattern, docPath string) bool {
+	pattern = strings.TrimPrefix(pattern, `/`)
+	if strings.HasSuffix(pattern, `/`) {
+		return strings.HasPrefix(docPath, pattern)
+	}
+	matched, err := path.Match(pattern, docPath)
+
+	return matched || err != nil
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"testing"
+
+	enum "github.com/elephant-insurance/enumerations/v2"
+	"github.com/elephant-insurance/go-microservice-arch/v2/sec"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+func TestRequiredRoles(t *testing.T) {
+	rules := map[string][]string{
+		`admin/`:             {`Customer-Portal-AgencyAdmin`},
+		`admin/help/`:        {`Customer-Portal-AgencyAdmin`, `Customer-Portal-AgencySupport`},
+		`reports/*.pdf`:      {`Customer-Portal-Agent`},
+		`/agency/index.html`: {`Customer-Portal-AgencyAgent`},
+	}
+	tests := []struct {
+		docPath    string
+		restricted bool
+		roles      int
+	}{
+		{`/index.html`, false, 0},
+		{`/admin/index.html`, true, 1},
+		{`/admin/users/list.html`, true, 1},
+		{`/admin/help/index.html`, true, 2},
+		{`/administrators.html`, false, 0},
+		{`/reports/q1.pdf`, true, 1},
+		{`/reports/2024/q1.pdf`, false, 0},
+		{`/agency/index.html`, true, 1},
+	}
+	for _, test := range tests {
+		roles, restricted := RequiredRoles(rules, test.docPath)
+		if restricted != test.restricted || len(roles) != test.roles {
+			t.Errorf(`%v: got roles %v, restricted %v`, test.docPath, roles, restricted)
+		}
+	}
+
+	// a bad pattern locks everything rather than nothing
+	if _, restricted := RequiredRoles(map[string][]string{`[`: {`All`}}, `/index.html`); !restricted {
+		t.Error(`bad pattern should restrict everything`)
+	}
+
+	roles, _ := RequiredRoles(rules, `/admin/help/index.html`)
+	support := sec.AccessToken{Scope: []string{`Customer-Portal-AgencySupport`}}
+	if !support.IsRoleExist(roles) {
+		t.Error(`support should see the admin help`)
+	}
+	roles, _ = RequiredRoles(rules, `/admin/index.html`)
+	if support.IsRoleExist(roles) {
+		t.Error(`support shouldn't see the rest of admin`)
+	}
+	if admin := (sec.AccessToken{Scope: []string{`customer-portal-agencyadmin`}}); !admin.IsRoleExist(roles) {
+		t.Error(`roles should match regardless of case`)
+	}
+}
+
+func TestRolesFor(t *testing.T) {
+	defer func() { cfg.Config = nil }()
+	cfg.Config = &cfg.AppConfig{Projects: map[string]cfg.ProjectSettings{
+		`docs`: {Roles: map[string]string{`admin/`: `Customer-Portal-AgencyAdmin, Customer-Portal-Agent`}},
+	}}
+	manifest := map[string][]string{`internal/`: {`Customer-Portal-Agent`}}
+
+	rules := cfg.Config.RolesFor(`docs`, manifest)
+	if len(rules) != 1 || len(rules[`admin/`]) != 2 || rules[`admin/`][1] != string(enum.AgentRole.ElephantAgent.ID) {
+		t.Errorf(`config roles should replace the manifest's, got %v`, rules)
+	}
+	if rules := cfg.Config.RolesFor(`handbook`, manifest); len(rules[`internal/`]) != 1 {
+		t.Errorf(`manifest roles should apply without config roles, got %v`, rules)
+	}
+	if err := cfg.CheckRoleRule(`admin/`, []string{`Nobody`}); err == nil {
+		t.Error(`unknown role accepted`)
+	}
+	if err := cfg.CheckRoleRule(`/`, []string{`All`}); err == nil {
+		t.Error(`pattern covering the whole site accepted; that is what Access is for`)
+	}
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/clicker"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+// query parameters of a signed URL
+const (
+	SignatureParam = `sig`
+	ExpiresParam   = `expires`
+	ScopeParam     = `scope`
+)
+
+const (
+	defaultSignedMinutes    = 60
+	defaultMaxSignedMinutes = 7 * 24 * 60
+	// signatureVersion is part of what is signed, so that the format can change without old links meaning something new
+	signatureVersion = `v1`
+	signedDocument   = `document`
+	signedScope      = `scope`
+)
+
+var (
+	// ErrNoSigningKey is returned when there is no access key to sign URLs with
+	ErrNoSigningKey = errors.New(`no access key to sign URLs with`)
+	// ErrBadSigningRequest is returned when asked to sign something that isn't a path in the project
+	ErrBadSigningRequest = errors.New(`bad document or scope to sign`)
+
+	SignedURLsIssued   = &clicker.Clicker{}
+	SignedURLsAccepted = &clicker.Clicker{}
+	SignedURLsRejected = &clicker.Clicker{}
+)
+
+// SignedURL is a link that lets anybody who has it see a document, or the documents under a scope, until it expires
+type SignedURL struct {
+	URL     string    `json:"url"`
+	Project string    `json:"project"`
+	Scope   string    `json:"scope,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// SignURL signs a link to the document at docPath, a snapshot key starting with project, for minutes (0 for the default).
+// With a scope, a folder within the project, the link works for every document under it instead and points at the folder.
+// URLs are signed with AccessKey1 under Security, and accepted with AccessKey1 or AccessKey2, so that the keys can be rotated
+// the usual way: the old AccessKey1 becomes AccessKey2 until the links it signed have run out.
+func SignURL(project, docPath, scope string, minutes int) (*SignedURL, int, error) {
+	key := cfg.Config.Security.AccessKey1
+	if key == `` {
+		return nil, http.StatusNotFound, ErrNoSigningKey
+	}
+	defaultMinutes, maxMinutes := signedURLSettings()
+	if minutes <= 0 {
+		minutes = defaultMinutes
+	}
+	if minutes > maxMinutes {
+		minutes = maxMinutes
+	}
+
+	q := url.Values{}
+	mode, target, urlPath := signedDocument, docPath, `/`+docPath
+	if scope != `` {
+		clean := strings.TrimPrefix(path.Clean(`/`+scope), `/`)
+		if clean == `` || clean == `.` || clean != strings.Trim(scope, `/`) {
+			return nil, http.StatusBadRequest, ErrBadSigningRequest
+		}
+		scope = clean + `/`
+		mode, target, urlPath = signedScope, project+`/`+scope, `/`+project+`/`+scope
+		q.Set(ScopeParam, scope)
+	} else if !strings.HasPrefix(docPath, project+`/`) {
+		return nil, http.StatusBadRequest, ErrBadSigningRequest
+	}
+
+	expires := time.Now().Add(time.Duration(minutes) * time.Minute).Truncate(time.Second)
+	q.Set(ExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+	q.Set(SignatureParam, signature(key, project, mode, target, expires.Unix()))
+	SignedURLsIssued.Click(1)
+
+	return &SignedURL{
+		URL:     (&url.URL{Path: urlPath, RawQuery: q.Encode()}).String(),
+		Project: project,
+		Scope:   scope,
+		Expires: expires.UTC(),
+	}, http.StatusOK, nil
+}
+
+// SignedURLAllows reports whether the request query carries a signature, still good, for the document at docPath in project
+func SignedURLAllows(project, docPath string, q url.Values) bool {
+	sig := q.Get(SignatureParam)
+	if sig == `` {
+		return false
+	}
+	expires, err := strconv.ParseInt(q.Get(ExpiresParam), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		SignedURLsRejected.Click(1)
+		return false
+	}
+
+	mode, target := signedDocument, docPath
+	if scope := q.Get(ScopeParam); scope != `` {
+		mode, target = signedScope, project+`/`+scope
+		if !strings.HasSuffix(scope, `/`) || !strings.HasPrefix(docPath, target) {
+			SignedURLsRejected.Click(1)
+			return false
+		}
+	}
+	for _, key := range []string{cfg.Config.Security.AccessKey1, cfg.Config.Security.AccessKey2} {
+		if key != `` && hmac.Equal([]byte(sig), []byte(signature(key, project, mode, target, expires))) {
+			SignedURLsAccepted.Click(1)
+			return true
+		}
+	}
+	SignedURLsRejected.Click(1)
+
+	return false
+}
+
+// signature is the HMAC of everything a signed URL promises, with key
+func signature(key, project, mode, target string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(strings.Join([]string{signatureVersion, project, mode, target, strconv.FormatInt(expires, 10)}, "\n")))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signedURLSettings() (defaultMinutes, maxMinutes int) {
+	defaultMinutes, maxMinutes = defaultSignedMinutes, defaultMaxSignedMinutes
+	su := cfg.Config.SignedURLs
+	if su.MaxMinutes != nil && *su.MaxMinutes > 0 {
+		maxMinutes = *su.MaxMinutes
+	}
+	if su.DefaultMinutes != nil && *su.DefaultMinutes > 0 {
+		defaultMinutes = *su.DefaultMinutes
+	}
+	if defaultMinutes > maxMinutes {
+		defaultMinutes = maxMinutes
+	}
+
+	return
+}
+
+// SignedURLDiagnostics counts the signed URLs we have handed out and seen
+func SignedURLDiagnostics() map[string]interface{} {
+	return map[string]interface{}{
+		`issued`:   SignedURLsIssued.Clicks,
+		`accepted`: SignedURLsAccepted.Clicks,
+		`rejected`: SignedURLsRejected.Clicks,
+	}
+}
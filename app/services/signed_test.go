@@ -0,0 +1,80 @@
+package services
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/sec"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+func TestSignedURLs(t *testing.T) {
+	defer func() { cfg.Config = nil }()
+	cfg.Config = &cfg.AppConfig{Security: sec.Settings{AccessKey1: `new-key`, AccessKey2: `old-key`}}
+
+	signed, _, err := SignURL(`docs`, `docs/guide/manual.pdf`, ``, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(signed.URL)
+	if u.Path != `/docs/guide/manual.pdf` || time.Until(signed.Expires) > 30*time.Minute {
+		t.Fatalf(`bad signed URL %+v`, signed)
+	}
+	q := u.Query()
+	if !SignedURLAllows(`docs`, `docs/guide/manual.pdf`, q) {
+		t.Error(`signed URL not accepted`)
+	}
+	if SignedURLAllows(`docs`, `docs/guide/other.pdf`, q) || SignedURLAllows(`handbook`, `docs/guide/manual.pdf`, q) {
+		t.Error(`signed URL accepted for another document`)
+	}
+	widened := url.Values{SignatureParam: {q.Get(SignatureParam)}, ExpiresParam: {q.Get(ExpiresParam)}, ScopeParam: {`guide/`}}
+	if SignedURLAllows(`docs`, `docs/guide/other.pdf`, widened) {
+		t.Error(`document signature accepted as a scope`)
+	}
+	later := url.Values{SignatureParam: {q.Get(SignatureParam)}, ExpiresParam: {strconv.FormatInt(time.Now().Add(time.Hour*24).Unix(), 10)}}
+	if SignedURLAllows(`docs`, `docs/guide/manual.pdf`, later) {
+		t.Error(`signed URL accepted with a later expiry`)
+	}
+
+	scoped, _, err := SignURL(`docs`, ``, `/reports`, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ = url.Parse(scoped.URL)
+	if u.Path != `/docs/reports/` || scoped.Scope != `reports/` {
+		t.Fatalf(`bad scoped URL %+v`, scoped)
+	}
+	q = u.Query()
+	if !SignedURLAllows(`docs`, `docs/reports/2024/q1.pdf`, q) {
+		t.Error(`scoped URL not accepted under its scope`)
+	}
+	if SignedURLAllows(`docs`, `docs/reports-private/q1.pdf`, q) || SignedURLAllows(`docs`, `docs/index.html`, q) {
+		t.Error(`scoped URL accepted outside its scope`)
+	}
+	if _, _, err := SignURL(`docs`, ``, `../handbook`, 0); err != ErrBadSigningRequest {
+		t.Errorf(`scope outside the project signed, got %v`, err)
+	}
+
+	// rotation: what the old key signed still works from AccessKey2, until it is dropped
+	cfg.Config.Security = sec.Settings{AccessKey1: `newer-key`, AccessKey2: `new-key`}
+	if !SignedURLAllows(`docs`, `docs/reports/q1.pdf`, q) {
+		t.Error(`signed URL rejected after rotation`)
+	}
+	cfg.Config.Security = sec.Settings{AccessKey1: `newest-key`, AccessKey2: `newer-key`}
+	if SignedURLAllows(`docs`, `docs/reports/q1.pdf`, q) {
+		t.Error(`signed URL accepted after its key was dropped`)
+	}
+
+	expired := url.Values{ExpiresParam: {strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)}}
+	expired.Set(SignatureParam, signature(`newest-key`, `docs`, signedDocument, `docs/index.html`, time.Now().Add(-time.Minute).Unix()))
+	if SignedURLAllows(`docs`, `docs/index.html`, expired) {
+		t.Error(`expired signed URL accepted`)
+	}
+
+	cfg.Config.Security = sec.Settings{}
+	if _, _, err := SignURL(`docs`, `docs/index.html`, ``, 0); err != ErrNoSigningKey {
+		t.Errorf(`signed without a key, got %v`, err)
+	}
+}
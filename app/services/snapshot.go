@@ -0,0 +1,186 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/clicker"
+)
+
+// Snapshot is the full set of files for one release of a project, as extracted from its archive
+type Snapshot struct {
+	Project string
+	Release string
+	// Source is the name of the blob the snapshot was extracted from
+	Source string
+	// ETag is the ETag of the source blob when we downloaded it
+	ETag string
+	// Loaded is when the files were extracted
+	Loaded time.Time
+	// Manifest is what the site says about itself, in its SiteManifestName file
+	Manifest SiteManifest
+	// Hits counts the documents served from the snapshot
+	Hits *clicker.Clicker
+	// checked is when we last made sure the files were current
+	checked time.Time
+	files   map[string]*snapshotFile
+	// spillDir holds the files too big to keep in memory, if there are any
+	spillDir string
+	// diskFolder is the disk cache folder holding the files, if the snapshot was loaded from there
+	diskFolder string
+	sync.Mutex
+}
+
+// snapshotFile is one file in a snapshot, held in memory or, if it is big, on disk
+type snapshotFile struct {
+	data []byte
+	path string
+	size int64
+	etag string
+}
+
+func newSnapshot(project string) *Snapshot {
+	rn := time.Now()
+	return &Snapshot{
+		Project: project,
+		Loaded:  rn,
+		checked: rn,
+		Hits:    &clicker.Clicker{},
+		files:   map[string]*snapshotFile{},
+	}
+}
+
+// Open returns the contents of the file at docPath in the snapshot, and its size
+func (s *Snapshot) Open(docPath string) (io.ReadCloser, int64, error) {
+	if s == nil {
+		return nil, 0, os.ErrNotExist
+	}
+
+	f, found := s.files[docPath]
+	if !found {
+		return nil, 0, os.ErrNotExist
+	}
+	if f.path == `` {
+		return io.NopCloser(bytes.NewReader(f.data)), f.size, nil
+	}
+	// a file we have spilled may have been removed since, if the snapshot has been replaced
+	rc, err := os.Open(f.path)
+	return rc, f.size, err
+}
+
+// FileETag returns a strong ETag for the file at docPath, based on its contents, so that it stays the same across releases and pods
+func (s *Snapshot) FileETag(docPath string) string {
+	if s == nil {
+		return ``
+	}
+	f, found := s.files[docPath]
+	if !found {
+		return ``
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if f.etag == `` {
+		h := sha256.New()
+		h.Write(f.data)
+		f.etag = etagFromHash(h)
+	}
+
+	return f.etag
+}
+
+func etagFromHash(h hash.Hash) string {
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// readFile reads a file into the snapshot, keeping it in memory if it is small enough and spilling it to disk if not
+func (s *Snapshot) readFile(r io.Reader, limits *limitTracker) (*snapshotFile, error) {
+	head, err := io.ReadAll(io.LimitReader(r, limits.limits.spillBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(head)) <= limits.limits.spillBytes {
+		if err := limits.addFileBytes(int64(len(head))); err != nil {
+			return nil, err
+		}
+		return &snapshotFile{data: head, size: int64(len(head))}, nil
+	}
+
+	if s.spillDir == `` {
+		if s.spillDir, err = os.MkdirTemp(limits.limits.spillDir, `ms-sites-`); err != nil {
+			return nil, err
+		}
+	}
+	out, err := os.CreateTemp(s.spillDir, `file-`)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	w := io.MultiWriter(out, h)
+	_, err = w.Write(head)
+	var rest int64
+	if err == nil {
+		rest, err = io.Copy(w, io.LimitReader(r, limits.limits.fileBytes+1-int64(len(head))))
+	}
+	if errClose := out.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = limits.addFileBytes(int64(len(head)) + rest)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return nil, err
+	}
+
+	return &snapshotFile{path: out.Name(), size: int64(len(head)) + rest, etag: etagFromHash(h)}, nil
+}
+
+// discard removes any files the snapshot has spilled to disk; it must not be served afterwards
+func (s *Snapshot) discard() {
+	if s == nil || s.spillDir == `` {
+		return
+	}
+
+	os.RemoveAll(s.spillDir)
+}
+
+// retire discards the snapshot once requests already being served from it have had time to finish
+func (s *Snapshot) retire() {
+	if s == nil || s.spillDir == `` {
+		return
+	}
+
+	time.AfterFunc(cacheExpirationSeconds*time.Second, s.discard)
+}
+
+// fresh reports whether the snapshot was checked against the container recently enough to serve without checking again
+func (s *Snapshot) fresh() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return time.Since(s.checked) < cacheExpirationSeconds*time.Second
+}
+
+// touch marks the snapshot as checked, without changing its files
+func (s *Snapshot) touch() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.checked = time.Now()
+}
+
+// siteKey is the cache key for a release of a project
+func siteKey(project, release string) string {
+	if release == `` {
+		release = DefaultRelease
+	}
+
+	return project + `@` + release
+}
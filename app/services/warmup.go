@@ -0,0 +1,261 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elephant-insurance/go-microservice-arch/v2/dig"
+	"github.com/elephant-insurance/go-microservice-arch/v2/log"
+	"github.com/elephant-insurance/go-microservice-arch/v2/msrqc"
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+// WarmupAllProjects in the warm-up list means every project with an archive at the top of the container
+const WarmupAllProjects = `*`
+
+const (
+	defaultWarmupParallelism = 4
+	defaultWarmupWaitSeconds = 60
+)
+
+// warmupProgress tracks the most recent warm-up
+type warmupProgress struct {
+	Started  time.Time
+	Finished time.Time
+	Total    int
+	Done     int
+	Failures map[string]string
+	sync.Mutex
+}
+
+var warmup = &warmupProgress{}
+
+// start resets the progress for a new warm-up
+func (wp *warmupProgress) start() {
+	wp.Lock()
+	defer wp.Unlock()
+	wp.Started, wp.Finished = time.Now(), time.Time{}
+	wp.Total, wp.Done = 0, 0
+	wp.Failures = map[string]string{}
+}
+
+// warmupSettings returns how many projects to load at once and how long startup waits for them, or their defaults
+func warmupSettings() (parallelism int, wait time.Duration) {
+	parallelism, wait = defaultWarmupParallelism, defaultWarmupWaitSeconds*time.Second
+	if cfg.Config == nil {
+		return
+	}
+	ws := cfg.Config.Warmup
+	if ws.Parallelism != nil && *ws.Parallelism > 0 {
+		parallelism = *ws.Parallelism
+	}
+	if ws.WaitSeconds != nil && *ws.WaitSeconds >= 0 {
+		wait = time.Duration(*ws.WaitSeconds) * time.Second
+	}
+
+	return
+}
+
+// Warmup loads the configured projects into the cache, several at a time, and returns once they are all loaded or have failed,
+// or once the configured wait is up; whatever is left carries on loading in the background.
+// If a refresh interval is configured, it then keeps loading them on that schedule until c is done.
+func (bs *BlobService) Warmup(c context.Context) {
+	if len(cfg.Config.WarmupProjects()) == 0 {
+		return
+	}
+
+	// started before we return, so the diagnostic never reports the warm-up as not configured
+	warmup.start()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bs.warmupOnce(c)
+	}()
+	_, wait := warmupSettings()
+	timer := time.NewTimer(wait)
+	select {
+	case <-done:
+	case <-c.Done():
+	case <-timer.C:
+		log.ForFunc(c).WithConsoleField("wait", wait).Warn("cache warm-up still running, carrying on without it")
+	}
+	timer.Stop()
+
+	if minutes := cfg.Config.Warmup.RefreshMinutes; minutes != nil && *minutes > 0 {
+		go func() {
+			// the first warm-up has to finish before the next can start
+			<-done
+			ticker := time.NewTicker(time.Duration(*minutes) * time.Minute)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-c.Done():
+					return
+				case <-ticker.C:
+					warmup.start()
+					bs.warmupOnce(c)
+				}
+			}
+		}()
+	}
+}
+
+// warmupOnce loads every release of the configured projects we might be asked to serve, several projects at a time
+func (bs *BlobService) warmupOnce(parent context.Context) {
+	c := msrqc.New(parent)
+	lw := log.ForFunc(c)
+
+	projects, err := bs.warmupProjects(c)
+	warmup.Lock()
+	warmup.Total = len(projects)
+	if err != nil {
+		warmup.Failures[WarmupAllProjects] = err.Error()
+	}
+	warmup.Unlock()
+
+	parallelism, _ := warmupSettings()
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for project := range work {
+				// each load logs with a context of its own
+				bs.warmupProject(msrqc.New(parent), project)
+			}
+		}()
+	}
+	for _, project := range projects {
+		work <- project
+	}
+	close(work)
+	wg.Wait()
+
+	warmup.Lock()
+	warmup.Finished = time.Now()
+	lw.WithConsoleField("projects", warmup.Total).WithConsoleField("failures", len(warmup.Failures)).Info("cache warm-up complete")
+	warmup.Unlock()
+}
+
+// warmupProject loads every release of project we might be asked to serve
+func (bs *BlobService) warmupProject(c msrqc.Context, project string) {
+	for _, release := range bs.servedReleases(c, project) {
+		if errDownload, _ := bs.DownloadFiles(c, project, release); errDownload != nil {
+			log.ForFunc(c).SetName(project).WithError(errDownload).Error("error warming up project")
+			warmup.Lock()
+			warmup.Failures[siteKey(project, release)] = errDownload.Error()
+			warmup.Unlock()
+		}
+	}
+	warmup.Lock()
+	warmup.Done++
+	warmup.Unlock()
+}
+
+// warmupProjects returns the projects to load: the configured list, or all of them
+func (bs *BlobService) warmupProjects(c msrqc.Context) ([]string, error) {
+	rtn := []string{}
+	for _, project := range cfg.Config.WarmupProjects() {
+		if project != WarmupAllProjects {
+			rtn = append(rtn, project)
+			continue
+		}
+		all, err := bs.ListProjects(c)
+		if err != nil {
+			return rtn, err
+		}
+		rtn = append(rtn, all...)
+	}
+
+	// archives only: blob mode projects are fetched file by file as they are asked for
+	seen := map[string]bool{}
+	projects := rtn[:0]
+	for _, project := range rtn {
+		if !seen[project] && cfg.Config.ForProject(project).Mode != cfg.ModeBlob {
+			projects = append(projects, project)
+		}
+		seen[project] = true
+	}
+
+	return projects, nil
+}
+
+// servedReleases returns the releases of project that visitors can be sent to: the stable one, and the canary if there is one
+func (bs *BlobService) servedReleases(c msrqc.Context, project string) []string {
+	ps := cfg.Config.ForProject(project)
+	stable := ps.Release
+	if stable == `` {
+		stable = bs.ActiveRelease(c, project)
+	}
+	if ps.Canary != nil && ps.Canary.Release != `` && ps.Canary.Release != stable {
+		return []string{stable, ps.Canary.Release}
+	}
+
+	return []string{stable}
+}
+
+// ListProjects returns every project with a default archive at the top of the container
+func (bs *BlobService) ListProjects(c msrqc.Context) ([]string, error) {
+	client, err := bs.initializeClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{}
+	pager := client.NewListBlobsFlatPager(bs.containerName, nil)
+	for pager.More() {
+		page, err := pager.NextPage(c)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Segment.BlobItems {
+			if item.Name == nil || strings.Contains(*item.Name, `/`) {
+				continue
+			}
+			for _, ae := range archiveExtensions {
+				if strings.HasSuffix(*item.Name, ae.extension) {
+					found[strings.TrimSuffix(*item.Name, ae.extension)] = true
+					break
+				}
+			}
+		}
+	}
+
+	rtn := make([]string, 0, len(found))
+	for project := range found {
+		// we've seen it in the container, so looking it up never counts against unknown lookups
+		foundProjects.Set(project, true, 0)
+		rtn = append(rtn, project)
+	}
+	sort.Strings(rtn)
+
+	return rtn, nil
+}
+
+// TestWarmup is a diagnostic test reporting how the last cache warm-up went
+func TestWarmup() (dig.DiagnosticResult, error) {
+	warmup.Lock()
+	defer warmup.Unlock()
+
+	switch {
+	case warmup.Started.IsZero():
+		return *dig.NewResult().Succeed().SetDescription("no cache warm-up configured"), nil
+	case warmup.Finished.IsZero():
+		// neither a success nor a failure yet
+		return *dig.NewResult().SetDescriptionf("cache warm-up in progress, %v of %v projects loaded", warmup.Done, warmup.Total), nil
+	case len(warmup.Failures) > 0:
+		failed := []string{}
+		for key, reason := range warmup.Failures {
+			failed = append(failed, fmt.Sprintf(`%v: %v`, key, reason))
+		}
+		sort.Strings(failed)
+		return *dig.NewResult().Fail().SetDescriptionf("cache warm-up failed for %v", strings.Join(failed, `; `)), nil
+	}
+
+	return *dig.NewResult().Succeed().SetDescriptionf("cache warm-up loaded %v projects in %v", warmup.Total, warmup.Finished.Sub(warmup.Started)), nil
+}
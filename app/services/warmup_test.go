@@ -0,0 +1,78 @@
+package services
+
+import (
+	"archive/tar"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elephant-insurance/ms-sites/app/cfg"
+)
+
+func TestWarmupInBackground(t *testing.T) {
+	parallelism, wait := 2, 0
+	cfg.Config = &cfg.AppConfig{Warmup: cfg.WarmupSettings{Projects: `a,b,c,d`, Parallelism: &parallelism, WaitSeconds: &wait}}
+	c, cancel := context.WithCancel(context.Background())
+	defer func() { cancel(); cfg.Config = nil; Purge(``); activeReleases.Flush(); warmup = &warmupProgress{} }()
+
+	site := makeTarGz(t, []testEntry{{`index.html`, tar.TypeReg, `home`}})
+	sc := &stubContainer{gets: map[string]int{}, blobs: map[string][]byte{}}
+	for _, project := range []string{`a`, `b`, `c`, `d`} {
+		sc.blobs[project+`.tar.gz`] = site
+	}
+
+	// archive downloads wait for the gate, so we can see how many run at once
+	gate := make(chan struct{})
+	var lock sync.Mutex
+	loading, most := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, `.tar.gz`) {
+			lock.Lock()
+			loading++
+			if loading > most {
+				most = loading
+			}
+			lock.Unlock()
+			<-gate
+			lock.Lock()
+			loading--
+			lock.Unlock()
+		}
+		sc.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	bs := NewBlobServiceAt(server.URL, `sites`, ``, `sites`)
+
+	// with no wait, startup carries on while the projects load
+	bs.Warmup(c)
+	if result, _ := TestWarmup(); result.Success != nil || result.Description == nil || !strings.Contains(*result.Description, `in progress`) {
+		t.Errorf(`expected warm-up to be reported in progress, got %+v`, result)
+	}
+
+	waitFor := func(what string, done func() bool) {
+		for deadline := time.Now().Add(5 * time.Second); !done(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf(`timed out waiting for %v`, what)
+			}
+		}
+	}
+	waitFor(`projects to load`, func() bool { lock.Lock(); defer lock.Unlock(); return loading == parallelism })
+	close(gate)
+	waitFor(`warm-up to finish`, func() bool { warmup.Lock(); defer warmup.Unlock(); return !warmup.Finished.IsZero() })
+
+	if most != parallelism {
+		t.Errorf(`expected %v projects loaded at once, got %v`, parallelism, most)
+	}
+	if result, _ := TestWarmup(); result.Success == nil || !*result.Success {
+		t.Errorf(`expected warm-up to succeed, got %+v`, result)
+	}
+	for _, project := range []string{`a`, `b`, `c`, `d`} {
+		if snap, _ := FindInCache(project, DefaultRelease); snap == nil {
+			t.Errorf(`expected project %v to be cached`, project)
+		}
+	}
+}
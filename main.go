@@ -5,6 +5,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/elephant-insurance/go-microservice-arch/v2/alert"
 	"github.com/elephant-insurance/go-microservice-arch/v2/cors"
 	"github.com/elephant-insurance/go-microservice-arch/v2/dig"
 	"github.com/elephant-insurance/go-microservice-arch/v2/glog"
@@ -53,7 +54,15 @@ func main() {
 	g.Use(glog.New(cfg.Config.RequiredConfig))
 	lw.Debug("glog initialized")
 
-	g.Use(cors.New(cfg.Config.RequiredConfig))
+	g.Use(controllers.SecurityHeaders())
+	lw.Debug("security headers initialized")
+
+	g.Use(controllers.RateLimit())
+	lw.Debug("rate limits initialized")
+
+	// projects may have CORS policies of their own, over the global one;
+	// answering a preflight may load a site, so it comes after the rate limits
+	g.Use(controllers.CORS(cors.New(cfg.Config.RequiredConfig)))
 	lw.Debug("cors initialized")
 
 	router := routes.Initialize(cfg.Config.RequiredConfig, g)
@@ -67,8 +76,15 @@ func main() {
 // Use this to keep the body of main() the same for all microservices.
 func setupApplicationPackages(c context.Context) {
 	lw := log.ForFunc(c)
-	bs := services.NewBlobService(cfg.Config.StorageAccountName, cfg.Config.StorageAccountKey, "singlesearch")
+	bs := services.NewBlobServiceAt(cfg.Config.StorageServiceURL, cfg.Config.StorageAccountName, cfg.Config.StorageAccountKey, "singlesearch")
 	services.Blob = bs
+	if err := services.InitializeDiskCache(c); err != nil {
+		// we can run without it, just more slowly
+		lw.WithError(err).Error(`disk cache disabled`)
+	}
+	services.InitializePeers(c)
+	// load the busiest sites before we start listening, so that nobody waits for them
+	bs.Warmup(c)
 	lw.Debug(`application package initialization complete`)
 }
 
@@ -78,7 +94,10 @@ func setupDiagnostics(c context.Context) {
 	lw := log.ForFunc(c)
 	dig.AddPackageStats("default-log", log.Diagnostics)
 	dig.AddPackageStats("cache-info", controllers.Diagnostics)
+	dig.AddPackageStats("peers", services.PeerDiagnostics)
 	dig.AddDiagnosticTest("storage-container-connection-test", services.TestContainer)
+	dig.AddDiagnosticTest("cache-warmup", services.TestWarmup)
+	alert.AddAnalytic(services.LimitAlerts)
 	// uncomment if we're using compressed requests
 	// dig.AddPackageStats(`gzip`, gzip.Diagnostics)
 	lw.Debug(`diagnostic tests and stats methods initialized`)
@@ -0,0 +1,79 @@
+// post-events sends sample Azure Event Grid batches to a running ms-sites, the way an Event Grid subscription would,
+// with the key in an X-Event-Key header, so that storage event handling can be tried locally without a storage account.
+//
+//	go run ./tools/post-events -key some-long-random-string app/services/testdata/events/validation.json
+//	go run ./tools/post-events -key some-long-random-string app/services/testdata/events/blob-created.json
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// subscriptionValidationEvent is the event type of the handshake Event Grid sends to new subscriptions
+const subscriptionValidationEvent = `Microsoft.EventGrid.SubscriptionValidationEvent`
+
+func main() {
+	endpoint := flag.String(`url`, `http://localhost:4000/events/storage`, `storage event endpoint`)
+	key := flag.String(`key`, ``, `event key, as configured in Events.Key, sent in the X-Event-Key header`)
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, `usage: post-events [-url URL] [-key KEY] FILE...`)
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, file := range flag.Args() {
+		if err := post(*endpoint, *key, file); err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", file, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// post sends the batch of events in file, with the headers Event Grid would send and the key, and prints the response
+func post(endpoint, key, file string) error {
+	body, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	events := []struct {
+		EventType string `json:"eventType"`
+	}{}
+	if err := json.Unmarshal(body, &events); err != nil {
+		return fmt.Errorf(`not an Event Grid batch: %w`, err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(`Content-Type`, `application/json`)
+	req.Header.Set(`aeg-event-type`, `Notification`)
+	if len(events) > 0 && events[0].EventType == subscriptionValidationEvent {
+		req.Header.Set(`aeg-event-type`, `SubscriptionValidation`)
+	}
+	// the key goes in a header, as a delivery property of the subscription; ms-sites refuses it in the URL
+	req.Header.Set(`X-Event-Key`, key)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	reply, _ := io.ReadAll(resp.Body)
+	fmt.Printf("%v: %v %s\n", file, resp.Status, reply)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf(`unexpected status %v`, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+// stub-idp is a tiny OpenID Connect provider that signs everybody in, so that the browser login flow can be tried
+// locally without a real identity provider. Point Login at it:
+//
+//	Login:
+//	  Issuer: http://localhost:4001
+//	  ClientID: ms-sites
+//	  RedirectURL: http://localhost:4000/auth/callback
+//	  SessionKey: at-least-thirty-two-characters-of-secret
+//
+//	go run ./tools/stub-idp -sub jdoe -groups docs-readers,docs-admins
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pendingLogin is what the stub remembers between handing out a code and exchanging it
+type pendingLogin struct {
+	clientID, redirectURI, challenge, nonce string
+}
+
+type stub struct {
+	issuer string
+	sub    string
+	groups []string
+	key    *rsa.PrivateKey
+
+	lock    sync.Mutex
+	pending map[string]pendingLogin
+}
+
+func main() {
+	addr := flag.String(`addr`, `localhost:4001`, `address to listen on`)
+	sub := flag.String(`sub`, `jdoe`, `subject of everybody who signs in`)
+	groups := flag.String(`groups`, ``, `comma-separated groups claim of everybody who signs in`)
+	flag.Parse()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := &stub{issuer: `http://` + *addr, sub: *sub, key: key, pending: map[string]pendingLogin{}}
+	if *groups != `` {
+		s.groups = strings.Split(*groups, `,`)
+	}
+
+	http.HandleFunc(`/.well-known/openid-configuration`, s.discovery)
+	http.HandleFunc(`/keys`, s.keys)
+	http.HandleFunc(`/authorize`, s.authorize)
+	http.HandleFunc(`/token`, s.token)
+	http.HandleFunc(`/logout`, func(w http.ResponseWriter, r *http.Request) { fmt.Fprintln(w, `signed out`) })
+	log.Printf(`stub identity provider at %v, signing everybody in as %v %v`, s.issuer, s.sub, s.groups)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func (s *stub) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		`issuer`:                 s.issuer,
+		`authorization_endpoint`: s.issuer + `/authorize`,
+		`token_endpoint`:         s.issuer + `/token`,
+		`end_session_endpoint`:   s.issuer + `/logout`,
+		`jwks_uri`:               s.issuer + `/keys`,
+	})
+}
+
+func (s *stub) keys(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{`keys`: []map[string]string{{
+		`kty`: `RSA`, `kid`: `stub`, `use`: `sig`, `alg`: `RS256`,
+		`n`: base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+		`e`: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+	}}})
+}
+
+// authorize signs the browser straight in and sends it back with a code
+func (s *stub) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get(`response_type`) != `code` || q.Get(`code_challenge_method`) != `S256` || q.Get(`redirect_uri`) == `` {
+		http.Error(w, `expected an authorization code request with an S256 code challenge`, http.StatusBadRequest)
+		return
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	code := hex.EncodeToString(b)
+	s.lock.Lock()
+	s.pending[code] = pendingLogin{clientID: q.Get(`client_id`), redirectURI: q.Get(`redirect_uri`), challenge: q.Get(`code_challenge`), nonce: q.Get(`nonce`)}
+	s.lock.Unlock()
+
+	back := url.Values{`code`: {code}, `state`: {q.Get(`state`)}}
+	http.Redirect(w, r, q.Get(`redirect_uri`)+`?`+back.Encode(), http.StatusFound)
+}
+
+// token exchanges a code for a signed identity token, checking the PKCE verifier
+func (s *stub) token(w http.ResponseWriter, r *http.Request) {
+	code := r.PostFormValue(`code`)
+	s.lock.Lock()
+	login, found := s.pending[code]
+	delete(s.pending, code)
+	s.lock.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostFormValue(`code_verifier`)))
+	if !found || r.PostFormValue(`redirect_uri`) != login.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != login.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{`error`: `invalid_grant`})
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		`iss`: s.issuer, `aud`: login.clientID, `sub`: s.sub, `name`: s.sub, `email`: s.sub + `@example.com`,
+		`groups`: s.groups, `nonce`: login.nonce, `iat`: now.Unix(), `exp`: now.Add(time.Hour).Unix(),
+	}
+	header, _ := json.Marshal(map[string]string{`alg`: `RS256`, `kid`: `stub`, `typ`: `JWT`})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + `.` + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		`id_token`:   signed + `.` + base64.RawURLEncoding.EncodeToString(sig),
+		`token_type`: `Bearer`,
+	})
+}